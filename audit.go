@@ -0,0 +1,283 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The audit log is rotated to audit.log.1 and so on once it grows past
+// auditMaxSize, and auditKeep rotated logs are kept.
+const (
+	auditMaxSize = 10 << 20
+	auditKeep    = 5
+)
+
+// Handlers that start a systemd job name it in this header
+const jobHeader = "X-Systemd-Job"
+
+// Form values that are never written to the audit log
+var auditRedacted = map[string]bool{
+	"password": true,
+}
+
+// AuditEntry records a request that changed something, or tried to.
+type AuditEntry struct {
+	Time     time.Time           `json:"time"`
+	Subject  string              `json:"subject,omitempty"`
+	User     string              `json:"user,omitempty"`
+	Remote   string              `json:"remote"`
+	Method   string              `json:"method"`
+	Path     string              `json:"path"`
+	Route    string              `json:"route"`
+	Unit     string              `json:"unit,omitempty"`
+	Params   map[string][]string `json:"params,omitempty"`
+	Status   int                 `json:"status"`
+	Job      string              `json:"job,omitempty"`
+	Duration float64             `json:"duration"`
+}
+
+var auditLog = struct {
+	sync.Mutex
+	path string
+}{}
+
+func setupAudit(o Options) {
+	auditLog.path = path.Join(o.Dir, o.StateDir, "audit.log")
+}
+
+// rotateAudit shifts the rotated logs up by one and starts a new log.
+func rotateAudit() error {
+	os.Remove(fmt.Sprintf("%s.%d", auditLog.path, auditKeep))
+	for i := auditKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", auditLog.path, i), fmt.Sprintf("%s.%d", auditLog.path, i+1))
+	}
+	return os.Rename(auditLog.path, auditLog.path+".1")
+}
+
+func writeAudit(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	if fi, err := os.Stat(auditLog.path); err == nil && fi.Size()+int64(len(data)) > auditMaxSize {
+		if err := rotateAudit(); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path.Dir(auditLog.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// mutating tells whether a request changes something. Starting units,
+// pulls, creates and updates have always been reachable with GET as well.
+func mutating(r *http.Request, match *mux.RouteMatch) bool {
+	switch match.Route.GetName() {
+	case "unit", "pull", "create":
+		return true
+	case "update":
+		return match.Vars["method"] != "status"
+	}
+	return r.Method != "GET" && r.Method != "HEAD"
+}
+
+// statusRecorder keeps the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// audit wraps handler, which serves the routes of router, so that the
+// requests that change something are recorded, including those refused.
+func audit(router *mux.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if !router.Match(r, &match) || !mutating(r, &match) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+
+		caller := callerOf(r)
+		entry := &AuditEntry{
+			Time:     start.UTC(),
+			Subject:  caller.Subject,
+			User:     caller.Name,
+			Remote:   r.RemoteAddr,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Route:    match.Route.GetName(),
+			Unit:     routeUnit(&match),
+			Status:   rec.status,
+			Job:      w.Header().Get(jobHeader),
+			Duration: time.Since(start).Seconds(),
+		}
+		// Handlers parse the form themselves, or leave the query alone
+		params := r.Form
+		if params == nil {
+			params = r.URL.Query()
+		}
+		for key, values := range params {
+			if entry.Params == nil {
+				entry.Params = make(map[string][]string)
+			}
+			if auditRedacted[key] {
+				values = []string{"-"}
+			}
+			entry.Params[key] = values
+		}
+
+		if err := writeAudit(entry); err != nil {
+			log.Printf("Failed to write the audit log: %s", err)
+		}
+	})
+}
+
+// readAudit calls fn with the entries of the audit log, oldest first.
+func readAudit(fn func(*AuditEntry)) error {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	files := []string{auditLog.path}
+	for i := 1; i <= auditKeep; i++ {
+		files = append([]string{auditLog.path + "." + strconv.Itoa(i)}, files...)
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), auditMaxSize)
+		for scanner.Scan() {
+			entry := &AuditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				continue
+			}
+			fn(entry)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditHandler lists the audit log, filtered by ?since= and ?until= in
+// RFC 3339, ?user= for the common name or subject of the caller, and
+// ?unit= for a glob of the unit, container or image.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	var since, until time.Time
+	for _, t := range []struct {
+		key string
+		to  *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		v := r.FormValue(t.key)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid %s: %s\n", t.key, v)
+			return
+		}
+		*t.to = parsed
+	}
+	user := r.FormValue("user")
+	unit := r.FormValue("unit")
+	if _, err := path.Match(unit, ""); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid unit pattern: %s\n", unit)
+		return
+	}
+
+	entries := []*AuditEntry{}
+	err := readAudit(func(entry *AuditEntry) {
+		if !since.IsZero() && entry.Time.Before(since) {
+			return
+		}
+		if !until.IsZero() && !entry.Time.Before(until) {
+			return
+		}
+		if user != "" && user != entry.User && user != entry.Subject {
+			return
+		}
+		if !globMatch(unit, entry.Unit) {
+			return
+		}
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	outJson, _ := json.Marshal(entries)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
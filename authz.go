@@ -0,0 +1,183 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// AuthRule allows callers with Role to use a route on the units,
+// containers or images matching Unit with Verb. Route is the name of a mux
+// route, such as "unit" or "pull", and Verb is the method in the path, such
+// as start or stop, the verb of the route for pulls, creates and updates,
+// or else the HTTP method in lower case. Every field is a glob, and a
+// missing field matches anything:
+//
+//	[{"role": "ci", "route": "unit", "unit": "app-*.service", "verb": "st*"},
+//	 {"role": "ci", "route": "pull"},
+//	 {"role": "admin"}]
+type AuthRule struct {
+	Role  string `json:"role"`
+	Route string `json:"route"`
+	Unit  string `json:"unit"`
+	Verb  string `json:"verb"`
+}
+
+// authPolicy holds the rules in force. Without a policy file every request
+// is allowed.
+var authPolicy = struct {
+	sync.RWMutex
+	rules []*AuthRule
+}{}
+
+// globMatch matches s against a glob, where an empty glob matches anything.
+func globMatch(glob, s string) bool {
+	if glob == "" {
+		return true
+	}
+	matched, _ := path.Match(glob, s)
+	return matched
+}
+
+func (rule *AuthRule) allows(roles []string, route, unit, verb string) bool {
+	if !globMatch(rule.Route, route) || !globMatch(rule.Unit, unit) || !globMatch(rule.Verb, verb) {
+		return false
+	}
+	if rule.Role == "" || rule.Role == "*" {
+		return true
+	}
+	for _, role := range roles {
+		if globMatch(rule.Role, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAuthPolicy reads the rules of a policy file and checks them against
+// the routes of router.
+func loadAuthPolicy(p string, router *mux.Router) ([]*AuthRule, error) {
+	if p == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []*AuthRule{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", p, err)
+	}
+	for i, rule := range rules {
+		for _, glob := range []string{rule.Role, rule.Route, rule.Unit, rule.Verb} {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("Invalid %s: rule %d: bad pattern %q", p, i, glob)
+			}
+		}
+		if rule.Route != "" && !strings.ContainsAny(rule.Route, "*?[") && router.Get(rule.Route) == nil {
+			return nil, fmt.Errorf("Invalid %s: rule %d: no route named %q", p, i, rule.Route)
+		}
+	}
+	return rules, nil
+}
+
+func setAuthPolicy(rules []*AuthRule) {
+	authPolicy.Lock()
+	authPolicy.rules = rules
+	authPolicy.Unlock()
+}
+
+// routeUnit returns the unit, container or image named by a route.
+func routeUnit(match *mux.RouteMatch) string {
+	for _, key := range []string{"unit", "container", "name", "remote"} {
+		if v, exists := match.Vars[key]; exists {
+			return v
+		}
+	}
+	return ""
+}
+
+// routeVerbs name what the routes without a method in the path do. They
+// change something whatever the HTTP method, so a rule allowing "get"
+// mustn't let them through.
+var routeVerbs = map[string]string{
+	"pull":   "pull",
+	"create": "create",
+	"update": "attempt",
+}
+
+// requestVerb returns the verb rules are matched against.
+func requestVerb(r *http.Request, match *mux.RouteMatch) string {
+	if verb := match.Vars["method"]; verb != "" {
+		return verb
+	}
+	if verb, exists := routeVerbs[match.Route.GetName()]; exists {
+		return verb
+	}
+	verb := strings.ToLower(r.Method)
+	if mutating(r, match) && (verb == "get" || verb == "head") {
+		return "post"
+	}
+	return verb
+}
+
+// authorized tells whether any rule allows the request.
+func authorized(r *http.Request, match *mux.RouteMatch) bool {
+	authPolicy.RLock()
+	defer authPolicy.RUnlock()
+
+	if authPolicy.rules == nil {
+		return true
+	}
+
+	route := match.Route.GetName()
+	unit := routeUnit(match)
+	verb := requestVerb(r, match)
+
+	roles := callerOf(r).Roles
+	for _, rule := range authPolicy.rules {
+		if rule.allows(roles, route, unit, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize wraps router so that requests the policy doesn't allow are
+// refused before they reach a handler.
+func authorize(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if router.Match(r, &match) && !authorized(r, &match) {
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "Forbidden: %s %s\n", r.Method, r.URL.Path)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
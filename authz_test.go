@@ -0,0 +1,65 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestVerb(t *testing.T) {
+	nothing := func(http.ResponseWriter, *http.Request) {}
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/registry/pull/{remote:.*}", nothing).Name("pull")
+	r.HandleFunc("/docker/container/create/{container:.*}", nothing).Name("create")
+	r.HandleFunc("/containers/", nothing).Methods("GET").Name("containers")
+	r.HandleFunc("/units/{unit}/{method}/{mode}", nothing).Name("unit")
+	u := r.PathPrefix("/update").Subrouter()
+	u.HandleFunc("", nothing).Name("update")
+	u.HandleFunc("/", nothing).Name("update")
+	u.HandleFunc("/{method:status}", nothing).Methods("GET").Name("update")
+
+	setAuthPolicy([]*AuthRule{{Role: "*", Verb: "get"}})
+	defer setAuthPolicy(nil)
+
+	for _, test := range []struct {
+		method, url, verb string
+		allowed           bool
+	}{
+		{"GET", "/docker/registry/pull/busybox", "pull", false},
+		{"POST", "/docker/registry/pull/busybox", "pull", false},
+		{"GET", "/docker/container/create/app", "create", false},
+		{"GET", "/update/", "attempt", false},
+		{"GET", "/update/status", "status", false},
+		{"GET", "/units/a.service/start/replace", "start", false},
+		{"GET", "/containers/", "get", true},
+	} {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		var match mux.RouteMatch
+		if !r.Match(req, &match) {
+			t.Fatalf("%s %s matches no route", test.method, test.url)
+		}
+		if verb := requestVerb(req, &match); verb != test.verb {
+			t.Errorf("%s %s has the verb %s, want %s", test.method, test.url, verb, test.verb)
+		}
+		if allowed := authorized(req, &match); allowed != test.allowed {
+			t.Errorf("%s %s allowed: %v, want %v", test.method, test.url, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// isWhiteout reports whether a file marks a deletion: a .wh. file in AUFS
+// layers or a 0/0 character device in an overlay upper dir.
+func isWhiteout(fi os.FileInfo) bool {
+	if strings.HasPrefix(fi.Name(), docker.WhiteoutPrefix) {
+		return true
+	}
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Rdev == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// whitedOut reports whether p is deleted by a whiteout of itself or one
+// of its parents in any of the given layers.
+func whitedOut(layers []string, p string) bool {
+	for _, layer := range layers {
+		for q := p; q != "/"; q = path.Dir(q) {
+			wh := path.Join(layer, path.Dir(q), docker.WhiteoutPrefix+path.Base(q))
+			if _, err := os.Lstat(wh); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameFile reports whether a file of the rootfs is unchanged compared to
+// the file it was copied from.
+func sameFile(a, b os.FileInfo) bool {
+	if a.Mode() != b.Mode() {
+		return false
+	}
+	if a.IsDir() {
+		// Changed children report themselves
+		return true
+	}
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// layerFile returns the file p of the top most layer that has it, unless a
+// layer above deleted it.
+func layerFile(layers []string, p string) os.FileInfo {
+	for i, layer := range layers {
+		if whitedOut(layers[:i], p) {
+			return nil
+		}
+		if fi, err := os.Lstat(path.Join(layer, p)); err == nil {
+			return fi
+		}
+	}
+	return nil
+}
+
+// rootfsChanges compares a directory to the image layers, top most first,
+// with docker.Changes. A stacked rw layer only holds what changed, and
+// overlay marks deletions with 0/0 character devices instead of .wh.
+// files. A full rootfs holds every file, so unchanged files are filtered
+// and deletions are found by walking the layers. Files the policy kept out
+// of the rootfs when it was copied aren't deletions.
+func rootfsChanges(layers []string, root string, stacked bool, policy *docker.ExtractPolicy) ([]docker.Change, error) {
+	found, err := docker.Changes(layers, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []docker.Change
+	for _, change := range found {
+		// Skip AUFS metadata
+		if strings.HasPrefix(change.Path, "/"+docker.WhiteoutPrefix+docker.WhiteoutPrefix) {
+			continue
+		}
+		if change.Kind == docker.ChangeDelete {
+			changes = append(changes, change)
+			continue
+		}
+
+		fi, err := os.Lstat(path.Join(root, change.Path))
+		if err != nil {
+			return nil, err
+		}
+		if isWhiteout(fi) {
+			changes = append(changes, docker.Change{Path: change.Path, Kind: docker.ChangeDelete})
+			continue
+		}
+		if !stacked && change.Kind == docker.ChangeModify {
+			if orig := layerFile(layers, change.Path); orig != nil && sameFile(orig, fi) {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	if stacked {
+		return changes, nil
+	}
+
+	deleted := make(map[string]bool)
+	for i, layer := range layers {
+		err := filepath.Walk(layer, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			p, err = filepath.Rel(layer, p)
+			if err != nil {
+				return err
+			}
+			p = path.Join("/", p)
+			if p == "/" || isWhiteout(fi) || whitedOut(layers[:i], p) {
+				return nil
+			}
+			if policy != nil && rejectReason(policy, fi) != "" {
+				return nil
+			}
+			for q := p; q != "/"; q = path.Dir(q) {
+				if deleted[q] {
+					return nil
+				}
+			}
+			if _, err := os.Lstat(path.Join(root, p)); os.IsNotExist(err) {
+				deleted[p] = true
+				changes = append(changes, docker.Change{Path: p, Kind: docker.ChangeDelete})
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// containerChanges lists the files of a container that differ from the
+// image it was created from.
+func containerChanges(c *Context, container *Container) ([]docker.Change, error) {
+	if container.Info == nil {
+		return nil, fmt.Errorf("Container %s has no source image", container.Name)
+	}
+	img, err := c.Graph.Get(container.Info.Image)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := imageLayers(c, img)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container.Info.Storage {
+	case StorageAUFS, StorageOverlay:
+		rw := path.Join(containerStoragePath(c, container.Name), "rw")
+		return rootfsChanges(layers, rw, true, nil)
+	}
+	return rootfsChanges(layers, container.Path, false, container.Info.Policy)
+}
+
+// tarChanges streams a layer holding the changed files of root, with AUFS
+// whiteouts for deleted files.
+func tarChanges(root string, changes []docker.Change) io.Reader {
+	sort.Sort(changesByPath(changes))
+
+	pipeR, pipeW := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pipeW)
+		for _, change := range changes {
+			if err := tarChange(tw, root, change); err != nil {
+				pipeW.CloseWithError(err)
+				return
+			}
+		}
+		pipeW.CloseWithError(tw.Close())
+	}()
+	return pipeR
+}
+
+func tarChange(tw *tar.Writer, root string, change docker.Change) error {
+	name := strings.TrimPrefix(change.Path, "/")
+
+	if change.Kind == docker.ChangeDelete {
+		return tw.WriteHeader(&tar.Header{
+			Name:     path.Join(path.Dir(name), docker.WhiteoutPrefix+path.Base(name)),
+			Mode:     0600,
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		})
+	}
+
+	p := path.Join(root, change.Path)
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if fi.Mode().IsRegular() {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type changesByPath []docker.Change
+
+func (c changesByPath) Len() int           { return len(c) }
+func (c changesByPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c changesByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// commitHandler turns the changes of a container into a new image on top
+// of the image the container was created from, and tags it.
+func commitHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+
+	container, err := getContainer(c, vars["container"])
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find container: %s\n", vars["container"])
+		return
+	}
+	if container.Info == nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Container %s has no source image\n", container.Name)
+		return
+	}
+
+	repo := r.FormValue("repo")
+	tag := r.FormValue("tag")
+	if repo == "" {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "Missing repo\n")
+		return
+	}
+	if tag == "" {
+		tag = docker.DEFAULTTAG
+	}
+
+	source, err := c.Graph.Get(container.Info.Image)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	// The changed files are read through the rootfs
+	if err := mountRootfs(c, container.Name, container.Info); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	changes, err := containerChanges(c, container)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	img := &docker.Image{
+		ID:            docker.GenerateID(),
+		Parent:        source.ID,
+		Comment:       r.FormValue("comment"),
+		Created:       time.Now(),
+		DockerVersion: docker.VERSION,
+		Author:        r.FormValue("author"),
+		Config:        source.Config,
+		Architecture:  source.Architecture,
+	}
+	if img.Architecture == "" {
+		img.Architecture = runtime.GOARCH
+	}
+
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
+
+	if err := c.Graph.Register(tarChanges(container.Path, changes), false, img); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if err := c.Repositories.Set(repo, tag, img.ID, true); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	out := map[string]interface{}{
+		"id":      img.ID,
+		"changes": len(changes),
+	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
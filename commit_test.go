@@ -0,0 +1,105 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func commit(c *Context, name, form string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/containers/{container}/commit", func(w http.ResponseWriter, r *http.Request) {
+		commitHandler(w, r, c)
+	}).Methods("POST")
+	req := httptest.NewRequest("POST", "/containers/"+name+"/commit", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCommit(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	root := copyContainer(t, c)
+
+	if err := ioutil.WriteFile(path.Join(root, "new"), []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(root, "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := commit(c, "web", "repo=app&tag=v2&comment=test")
+	if w.Code != 200 {
+		t.Fatalf("Commit answered %d: %s", w.Code, w.Body)
+	}
+	var out struct {
+		ID      string `json:"id"`
+		Changes int    `json:"changes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Changes != 2 {
+		t.Fatalf("Committed %d changes, want 2", out.Changes)
+	}
+
+	img, err := c.Repositories.GetImage("app", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img == nil || img.ID != out.ID || img.Parent != testImageID || img.Comment != "test" {
+		t.Fatalf("app:v2 is %+v", img)
+	}
+	// The layer holds the new file and a whiteout for the deleted one
+	for _, name := range []string{"new", ".wh.hello"} {
+		if _, err := os.Lstat(path.Join(c.Graph.Root, img.ID, "layer", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCommitRefusals(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	copyContainer(t, c)
+	if err := os.Mkdir(path.Join(c.ContainerPath, "old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name, form string
+		code       int
+	}{
+		{"missing", "repo=app", 404},
+		{"old", "repo=app", 400},
+		{"web", "tag=v2", 400},
+	} {
+		if w := commit(c, test.name, test.form); w.Code != test.code {
+			t.Errorf("Committing %s with %s answered %d, want %d: %s", test.name, test.form, w.Code, test.code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const StateDir = "/var/lib/systemd-rest/"
+
+// Extractors unpack the layers of images and containers
+const (
+	ExtractorNative = "native"
+	ExtractorBsdtar = "bsdtar"
+)
+
+// Options are the settings of the daemon. They are read from the JSON file
+// given with -config, and the flags given on the command line override it.
+type Options struct {
+	Config string `json:"-"`
+
+	Dir           string `json:"dir"`
+	StateDir      string `json:"state_dir"`
+	ContainerDir  string `json:"container_dir"`
+	StorageDriver string `json:"storage_driver"`
+	MinFree       int64  `json:"min_free"`
+	Extractor     string `json:"extractor"`
+
+	Address    string `json:"address"`
+	Port       string `json:"port"`
+	UnixSocket string `json:"unix"`
+	UnixMode   string `json:"unix_mode"`
+	UnixGroup  string `json:"unix_group"`
+
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	TLSClientCA string `json:"tls_client_ca"`
+	ClientRoles string `json:"client_roles"`
+	AuthPolicy  string `json:"auth_policy"`
+
+	// Registries replace registries.json when they are set
+	Registries map[string]*RegistryConfig `json:"registries"`
+
+	// UnitTemplate is a file with a template replacing the built in unit
+	UnitTemplate     string `json:"unit_template"`
+	UnitTargetFormat string `json:"unit_target_format"`
+
+	RebootLock    string `json:"reboot_lock"`
+	RebootLockMax int    `json:"reboot_lock_max"`
+
+	// ShutdownTimeout is how many seconds requests get to finish on
+	// SIGTERM before pulls and creates are stopped
+	ShutdownTimeout int `json:"shutdown_timeout"`
+}
+
+var options = Options{}
+
+func newFlagSet(o *Options) *flag.FlagSet {
+	const (
+		defaultDir           = "/"
+		defaultPort          = "8080"
+		defaultStorageDriver = StorageAuto
+		defaultMinFree       = 1024
+		defaultExtractor     = ExtractorNative
+		defaultRebootLockMax = 1
+		defaultUnixMode      = "0660"
+		defaultShutdown      = 30
+	)
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&o.Config, "config", "", "JSON file with the settings, reloaded on SIGHUP")
+	fs.StringVar(&o.Dir, "D", defaultDir, "Directory prefix (default /)")
+	fs.StringVar(&o.Address, "a", "", "Address to bind to (default all interfaces)")
+	fs.StringVar(&o.Port, "p", defaultPort, "Port to bind to, or empty for none")
+	fs.StringVar(&o.UnixSocket, "unix", "", "Unix socket to listen on as well")
+	fs.StringVar(&o.UnixMode, "unix-mode", defaultUnixMode, "Permissions of the Unix socket")
+	fs.StringVar(&o.UnixGroup, "unix-group", "", "Group owning the Unix socket")
+	fs.StringVar(&o.StorageDriver, "s", defaultStorageDriver, "Container storage driver: auto, aufs, overlay, btrfs or copy")
+	fs.StringVar(&o.Extractor, "extractor", defaultExtractor, "How layers are unpacked: native or bsdtar")
+	fs.Int64Var(&o.MinFree, "min-free", defaultMinFree, "Megabytes that pulls and creates must leave free under the directory prefix")
+	fs.StringVar(&o.RebootLock, "reboot-lock", "", "Reboot lock file under the directory prefix, or URL of a lock server (default reboot-lock in the state directory)")
+	fs.IntVar(&o.RebootLockMax, "reboot-lock-max", defaultRebootLockMax, "Machines that may hold a reboot lock file at once")
+	fs.StringVar(&o.TLSCert, "tls-cert", "", "Serve HTTPS with this PEM certificate")
+	fs.StringVar(&o.TLSKey, "tls-key", "", "PEM key of the certificate")
+	fs.StringVar(&o.TLSClientCA, "tls-client-ca", "", "Require client certificates signed by the CAs in this PEM file")
+	fs.StringVar(&o.ClientRoles, "client-roles", "", "JSON file mapping client certificate subjects to roles")
+	fs.StringVar(&o.AuthPolicy, "auth-policy", "", "JSON file of the rules allowing roles to use routes, reloaded on SIGHUP")
+	fs.IntVar(&o.ShutdownTimeout, "shutdown-timeout", defaultShutdown, "Seconds requests get to finish on SIGTERM before pulls and creates are stopped")
+
+	o.StateDir = StateDir
+	o.ContainerDir = ContainerDir
+	o.UnitTargetFormat = UnitTargetFormat
+	return fs
+}
+
+// readOptions reads the config file named in args and then the flags of
+// args over it.
+func readOptions(args []string) (Options, error) {
+	o := Options{}
+	fs := newFlagSet(&o)
+	fs.Parse(args)
+	if o.Config == "" {
+		return o, o.validate()
+	}
+
+	data, err := ioutil.ReadFile(o.Config)
+	if err != nil {
+		return o, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&o); err != nil {
+		return o, fmt.Errorf("Invalid %s: %s", o.Config, err)
+	}
+	fs.Parse(args)
+	return o, o.validate()
+}
+
+func (o *Options) validate() error {
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return fmt.Errorf("The TLS certificate and key go together")
+	}
+	if o.TLSClientCA != "" && o.TLSCert == "" {
+		return fmt.Errorf("A TLS client CA needs a certificate and key")
+	}
+	if _, err := storageDrivers(o.StorageDriver); err != nil {
+		return err
+	}
+	if o.Extractor != ExtractorNative && o.Extractor != ExtractorBsdtar {
+		return fmt.Errorf("Invalid extractor: %s", o.Extractor)
+	}
+	if o.MinFree < 0 {
+		return fmt.Errorf("Invalid min_free: %d", o.MinFree)
+	}
+	if o.ShutdownTimeout < 0 {
+		return fmt.Errorf("Invalid shutdown_timeout: %d", o.ShutdownTimeout)
+	}
+	if o.RebootLockMax < 1 {
+		return fmt.Errorf("Invalid reboot_lock_max: %d", o.RebootLockMax)
+	}
+	if _, err := strconv.ParseUint(o.UnixMode, 8, 32); err != nil {
+		return fmt.Errorf("Invalid unix_mode: %s", o.UnixMode)
+	}
+	if strings.Count(o.UnitTargetFormat, "%") != 1 || !strings.Contains(o.UnitTargetFormat, "%s") {
+		return fmt.Errorf("Invalid unit_target_format, it needs a single %%s: %s", o.UnitTargetFormat)
+	}
+	for _, p := range []string{o.Dir, o.StateDir, o.ContainerDir, o.UnitTargetFormat} {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("Not an absolute path: %s", p)
+		}
+	}
+	return nil
+}
+
+// restartOnly reverts the settings of o that can't change while running
+// to those of old, and names those that were changed.
+func restartOnly(old Options, o *Options) []string {
+	var changed []string
+	revert := func(name string, from *string, to string) {
+		if *from != to {
+			changed = append(changed, name)
+			*from = to
+		}
+	}
+	revert("dir", &o.Dir, old.Dir)
+	revert("state_dir", &o.StateDir, old.StateDir)
+	revert("container_dir", &o.ContainerDir, old.ContainerDir)
+	revert("storage_driver", &o.StorageDriver, old.StorageDriver)
+	revert("extractor", &o.Extractor, old.Extractor)
+	revert("unit_target_format", &o.UnitTargetFormat, old.UnitTargetFormat)
+	revert("reboot_lock", &o.RebootLock, old.RebootLock)
+	if (o.TLSCert == "") != (old.TLSCert == "") {
+		revert("tls_cert", &o.TLSCert, old.TLSCert)
+		revert("tls_key", &o.TLSKey, old.TLSKey)
+		revert("tls_client_ca", &o.TLSClientCA, old.TLSClientCA)
+	}
+	if o.RebootLockMax != old.RebootLockMax {
+		changed = append(changed, "reboot_lock_max")
+		o.RebootLockMax = old.RebootLockMax
+	}
+	return changed
+}
+
+// liveSettings are the settings requests look up as they are served, so
+// that a reload applies to the requests that follow it.
+type liveSettings struct {
+	MinFree          int64
+	Registries       map[string]*RegistryConfig
+	UnitTemplate     *template.Template
+	UnitTargetFormat string
+	ShutdownTimeout  time.Duration
+}
+
+var live = struct {
+	sync.RWMutex
+	settings *liveSettings
+}{settings: &liveSettings{UnitTemplate: unitTemplate, UnitTargetFormat: UnitTargetFormat}}
+
+func newLiveSettings(o Options) (*liveSettings, error) {
+	s := &liveSettings{
+		MinFree:          o.MinFree << 20,
+		Registries:       o.Registries,
+		UnitTemplate:     unitTemplate,
+		UnitTargetFormat: o.UnitTargetFormat,
+		ShutdownTimeout:  time.Duration(o.ShutdownTimeout) * time.Second,
+	}
+	if o.UnitTemplate != "" {
+		data, err := ioutil.ReadFile(o.UnitTemplate)
+		if err != nil {
+			return nil, err
+		}
+		s.UnitTemplate, err = newUnitTemplate(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", o.UnitTemplate, err)
+		}
+	}
+	return s, nil
+}
+
+func setLiveSettings(s *liveSettings) {
+	live.Lock()
+	live.settings = s
+	live.Unlock()
+}
+
+func settings() *liveSettings {
+	live.RLock()
+	defer live.RUnlock()
+	return live.settings
+}
@@ -0,0 +1,44 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestRestartOnly(t *testing.T) {
+	old := Options{
+		StorageDriver:    StorageCopy,
+		UnitTargetFormat: "/etc/systemd/system/container-%s.service",
+		MinFree:          1024,
+	}
+	o := old
+	o.StorageDriver = StorageAUFS
+	o.UnitTargetFormat = "/run/systemd/system/app-%s.service"
+	o.MinFree = 2048
+
+	changed := restartOnly(old, &o)
+	if len(changed) != 2 || changed[0] != "storage_driver" || changed[1] != "unit_target_format" {
+		t.Fatalf("Reported %v as changed", changed)
+	}
+	if o.StorageDriver != old.StorageDriver || o.UnitTargetFormat != old.UnitTargetFormat {
+		t.Fatalf("Kept %s and %s", o.StorageDriver, o.UnitTargetFormat)
+	}
+	if o.MinFree != 2048 {
+		t.Fatalf("min_free is %d, want the reloaded 2048", o.MinFree)
+	}
+}
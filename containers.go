@@ -0,0 +1,382 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/gorilla/mux"
+	"github.com/philips/go-systemd"
+	"io"
+	"io/ioutil"
+	"launchpad.net/go-dbus"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+type Container struct {
+	Name string         `json:"name"`
+	Unit string         `json:"unit"`
+	Path string         `json:"path"`
+	Info *ContainerInfo `json:"info,omitempty"`
+}
+
+// unitTarget returns the path of the unit file of a container.
+func unitTarget(name string) string {
+	return fmt.Sprintf(settings().UnitTargetFormat, name)
+}
+
+// containerUnitTarget returns the path of the unit file a container runs
+// from. Containers created before the unit was generated are still run by
+// a link to the etcd@ template.
+func containerUnitTarget(name string) string {
+	target := unitTarget(name)
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		legacy := fmt.Sprintf(LegacyUnitTargetFormat, name)
+		if _, err := os.Lstat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return target
+}
+
+// containerUnit returns the name of the unit that runs a container.
+func containerUnit(name string) string {
+	return path.Base(containerUnitTarget(name))
+}
+
+func getContainer(c *Context, name string) (*Container, error) {
+	if !validContainerName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid container name: %s", name)
+	}
+	p := path.Join(c.ContainerPath, name)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a container", name)
+	}
+
+	container := &Container{
+		Name: name,
+		Unit: containerUnit(name),
+		Path: p,
+	}
+	// Containers created before the metadata existed have no info
+	if info, err := loadContainerInfo(c, name); err == nil {
+		container.Info = info
+	}
+	return container, nil
+}
+
+func listContainers(c *Context) ([]*Container, error) {
+	containers := []*Container{}
+
+	dir, err := ioutil.ReadDir(c.ContainerPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range dir {
+		if !fi.IsDir() {
+			continue
+		}
+		container, err := getContainer(c, fi.Name())
+		if err != nil {
+			// Not something created through the API
+			continue
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// How long a delete waits for the unit of a container to stop
+const (
+	unitStopTimeout = 90 * time.Second
+	unitStopPoll    = 250 * time.Millisecond
+)
+
+// waitStopped waits for a unit to stop once a stop job is queued. A unit
+// that isn't loaded is stopped.
+func waitStopped(s *systemd.Systemd1, unit string) error {
+	deadline := time.Now().Add(unitStopTimeout)
+	for {
+		state, err := s.ActiveState(unit)
+		if isNoSuchUnit(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if state == "inactive" || state == "failed" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is still %s", unit, state)
+		}
+		time.Sleep(unitStopPoll)
+	}
+}
+
+// isNoSuchUnit reports whether err is systemd complaining about a unit that
+// isn't loaded, which is fine when stopping a container that never ran.
+func isNoSuchUnit(err error) bool {
+	if e, ok := err.(*dbus.Error); ok {
+		return e.Name == "org.freedesktop.systemd1.NoSuchUnit"
+	}
+	return false
+}
+
+func containersHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	containers, err := listContainers(c)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	outJson, _ := json.Marshal(containers)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+func containerHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+
+	container, err := getContainer(c, vars["container"])
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find container: %s\n", vars["container"])
+		return
+	}
+
+	outJson, _ := json.Marshal(container)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+func containerUnitHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	var (
+		out interface{}
+	)
+
+	vars := mux.Vars(r)
+
+	container, err := getContainer(c, vars["container"])
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find container: %s\n", vars["container"])
+		return
+	}
+
+	s := new(systemd.Systemd1)
+	defer s.Close()
+	if err := s.Connect(); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	switch vars["method"] {
+	case "start":
+		if container.Info != nil {
+			if err := mountRootfs(c, container.Name, container.Info); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "%s\n", err)
+				return
+			}
+		}
+		out, err = s.StartUnit(container.Unit, "replace")
+	case "stop":
+		out, err = s.StopUnit(container.Unit, "replace")
+	}
+	if job, ok := out.(systemd.Job); ok && job.Id != "" {
+		w.Header().Set(jobHeader, job.Id)
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+	}
+
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+func deleteContainerHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+
+	container, err := getContainer(c, vars["container"])
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find container: %s\n", vars["container"])
+		return
+	}
+
+	s := new(systemd.Systemd1)
+	defer s.Close()
+	if err := s.Connect(); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	// The rootfs is removed once systemd-nspawn is gone, and the info
+	// goes last, so that a delete that fails can be repeated
+	if _, err := s.StopUnit(container.Unit, "replace"); err != nil && !isNoSuchUnit(err) {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if err := waitStopped(s, container.Unit); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	target := containerUnitTarget(container.Name)
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if err := s.Reload(); err != nil {
+		log.Printf("Failed to reload systemd: %s", err)
+	}
+
+	driver := StorageCopy
+	if container.Info != nil {
+		driver = container.Info.Storage
+	}
+	log.Printf("Deleting container %s", container.Path)
+	if err := removeRootfs(c, driver, container.Name, container.Path); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if err := os.Remove(containerInfoPath(c, container.Name)); err != nil && !os.IsNotExist(err) {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+// changesHandler lists the files of a container added, changed or deleted
+// since it was created from its image.
+func changesHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+
+	container, err := getContainer(c, vars["container"])
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find container: %s\n", vars["container"])
+		return
+	}
+	if container.Info == nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Container %s has no source image\n", container.Name)
+		return
+	}
+	if err := mountRootfs(c, container.Name, container.Info); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	changes, err := containerChanges(c, container)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if changes == nil {
+		changes = []docker.Change{}
+	}
+	sort.Sort(changesByPath(changes))
+
+	outJson, _ := json.Marshal(changes)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+var exportCompressions = map[string]docker.Compression{
+	"":      docker.Uncompressed,
+	"none":  docker.Uncompressed,
+	"bzip2": docker.Bzip2,
+	"gzip":  docker.Gzip,
+	"xz":    docker.Xz,
+}
+
+// exportHandler streams the rootfs of a container as a tarball, compressed
+// with ?compression=none|bzip2|gzip|xz.
+func exportHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+
+	container, err := getContainer(c, vars["container"])
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find container: %s\n", vars["container"])
+		return
+	}
+
+	compression, ok := exportCompressions[r.FormValue("compression")]
+	if !ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown compression: %s\n", r.FormValue("compression"))
+		return
+	}
+
+	if container.Info != nil {
+		if err := mountRootfs(c, container.Name, container.Info); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+	}
+
+	archive, err := docker.Tar(container.Path, compression)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", container.Name, compression.Extension()))
+	if _, err := io.Copy(w, archive); err != nil {
+		// The status is sent already, cut the stream short instead
+		log.Printf("Failed to export %s: %s", container.Name, err)
+	}
+}
+
+func setupContainers(r *mux.Router, o Options) {
+	// The containers share the docker context set up by setupDocker
+	r.HandleFunc("", makeHandler(containersHandler)).Methods("GET").Name("containers")
+	r.HandleFunc("/", makeHandler(containersHandler)).Methods("GET").Name("containers")
+	r.HandleFunc("/{container}", makeHandler(containerHandler)).Methods("GET").Name("container")
+	r.HandleFunc("/{container}", makeHandler(deleteContainerHandler)).Methods("DELETE").Name("delete-container")
+	r.HandleFunc("/{container}/{method:start|stop}", makeHandler(containerUnitHandler)).Methods("POST").Name("container-unit")
+	r.HandleFunc("/{container}/commit", makeHandler(commitHandler)).Methods("POST").Name("commit")
+	r.HandleFunc("/{container}/changes", makeHandler(changesHandler)).Methods("GET").Name("changes")
+	r.HandleFunc("/{container}/export", makeHandler(exportHandler)).Methods("GET").Name("export")
+
+	return
+}
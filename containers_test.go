@@ -0,0 +1,204 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/dotcloud/docker"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func serveContainers(c *Context, method, url string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	handle := func(fn func(http.ResponseWriter, *http.Request, *Context)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fn(w, r, c)
+		}
+	}
+	r.HandleFunc("/containers/", handle(containersHandler)).Methods("GET")
+	r.HandleFunc("/containers/{container}", handle(containerHandler)).Methods("GET")
+	r.HandleFunc("/containers/{container}", handle(deleteContainerHandler)).Methods("DELETE")
+	r.HandleFunc("/containers/{container}/{method:start|stop}", handle(containerUnitHandler)).Methods("POST")
+	r.HandleFunc("/containers/{container}/changes", handle(changesHandler)).Methods("GET")
+	r.HandleFunc("/containers/{container}/export", handle(exportHandler)).Methods("GET")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+func TestListContainers(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"web", "old"} {
+		if err := os.Mkdir(path.Join(c.ContainerPath, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveContainerInfo(c, "web", &ContainerInfo{Image: testImageID}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveContainers(c, "GET", "/containers/")
+	if w.Code != 200 {
+		t.Fatalf("Listing answered %d: %s", w.Code, w.Body)
+	}
+	var containers []*Container
+	if err := json.Unmarshal(w.Body.Bytes(), &containers); err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 {
+		t.Fatalf("Listed %d containers, want 2", len(containers))
+	}
+	for _, container := range containers {
+		switch container.Name {
+		case "web":
+			if container.Info == nil || container.Info.Image != testImageID {
+				t.Fatalf("web has the info %+v", container.Info)
+			}
+		case "old":
+			// Created before the metadata existed
+			if container.Info != nil {
+				t.Fatalf("old has the info %+v", container.Info)
+			}
+		default:
+			t.Fatalf("Listed the container %s", container.Name)
+		}
+	}
+}
+
+func TestUnknownContainer(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(c.ContainerPath, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method, url string
+	}{
+		{"GET", "/containers/missing"},
+		{"GET", "/containers/file"},
+		{"GET", "/containers/..."},
+		{"DELETE", "/containers/missing"},
+		{"POST", "/containers/missing/start"},
+		{"POST", "/containers/missing/stop"},
+		{"GET", "/containers/missing/changes"},
+		{"GET", "/containers/missing/export"},
+	} {
+		if w := serveContainers(c, test.method, test.url); w.Code != 404 {
+			t.Errorf("%s %s answered %d: %s", test.method, test.url, w.Code, w.Body)
+		}
+	}
+}
+
+// copyContainer creates the container web from app:v1 with the copy
+// driver.
+func copyContainer(t *testing.T, c *Context) string {
+	loadTestImage(t, c)
+	img, err := c.Graph.Get(testImageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := path.Join(c.ContainerPath, "web")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyRootfs(root, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveContainerInfo(c, "web", &ContainerInfo{Image: testImageID, Storage: StorageCopy}); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestContainerChanges(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	root := copyContainer(t, c)
+
+	if err := ioutil.WriteFile(path.Join(root, "new"), []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(root, "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveContainers(c, "GET", "/containers/web/changes")
+	if w.Code != 200 {
+		t.Fatalf("Changes answered %d: %s", w.Code, w.Body)
+	}
+	var changes []docker.Change
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil {
+		t.Fatal(err)
+	}
+	want := []docker.Change{{Path: "/hello", Kind: docker.ChangeDelete}, {Path: "/new", Kind: docker.ChangeAdd}}
+	if len(changes) != len(want) || changes[0] != want[0] || changes[1] != want[1] {
+		t.Fatalf("Changes are %v, want %v", changes, want)
+	}
+
+	// Without a source image there is nothing to compare with
+	if err := os.Remove(containerInfoPath(c, "web")); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveContainers(c, "GET", "/containers/web/changes"); w.Code != 400 {
+		t.Fatalf("Changes of a container without info answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestContainerExport(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	copyContainer(t, c)
+
+	if w := serveContainers(c, "GET", "/containers/web/export?compression=zip"); w.Code != 400 {
+		t.Fatalf("Export with an unknown compression answered %d: %s", w.Code, w.Body)
+	}
+
+	w := serveContainers(c, "GET", "/containers/web/export?compression=gzip")
+	if w.Code != 200 {
+		t.Fatalf("Export answered %d: %s", w.Code, w.Body)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("The export lacks hello")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Clean(hdr.Name) == "hello" {
+			break
+		}
+	}
+}
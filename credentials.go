@@ -0,0 +1,186 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// The public index is stored under this name
+const publicIndexName = "index"
+
+// Credential is what the API shows of stored credentials. The password
+// never leaves the host.
+type Credential struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// credentialsPath is the directory holding the .dockercfg of a registry
+// host, or of the public index if host is empty.
+func credentialsPath(c *Context, host string) string {
+	if host == "" {
+		host = publicIndexName
+	}
+	return path.Join(c.StatePath, "auth", host)
+}
+
+// loadCredentials returns the stored credentials of a registry host, or
+// nil if there are none.
+func loadCredentials(c *Context, host string) (*auth.AuthConfig, error) {
+	authConfig, err := auth.LoadConfig(credentialsPath(c, host))
+	if err == auth.ErrConfigFileMissing {
+		return nil, nil
+	}
+	return authConfig, err
+}
+
+func validRegistryHost(host string) bool {
+	return host != "" && host != "." && host != ".." && !strings.ContainsAny(host, "/\\")
+}
+
+func credentialsHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	credentials := []*Credential{}
+
+	dir, err := ioutil.ReadDir(path.Join(c.StatePath, "auth"))
+	if err != nil && !os.IsNotExist(err) {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	for _, fi := range dir {
+		host := fi.Name()
+		if host == publicIndexName {
+			host = ""
+		}
+		authConfig, err := loadCredentials(c, host)
+		if err != nil || authConfig == nil {
+			continue
+		}
+		credentials = append(credentials, &Credential{
+			Registry: fi.Name(),
+			Username: authConfig.Username,
+			Email:    authConfig.Email,
+		})
+	}
+
+	outJson, _ := json.Marshal(credentials)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+// loginHandler checks credentials against a registry and stores them if
+// they are accepted. Leave out the registry for the public index.
+func loginHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	host := r.FormValue("registry")
+	if host == publicIndexName {
+		host = ""
+	}
+	if host != "" && !validRegistryHost(host) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid registry: %s\n", host)
+		return
+	}
+
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	email := r.FormValue("email")
+	if username == "" || password == "" || email == "" {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "username, password and email are required\n")
+		return
+	}
+	// The stored credentials are username:password, so only the password
+	// may contain a colon
+	if strings.Contains(username, ":") {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "username can't contain ':'\n")
+		return
+	}
+
+	index, transport, err := registryTransport(c, host)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if index == "" {
+		index = auth.IndexServerAddress()
+	}
+
+	p := credentialsPath(c, host)
+	authConfig := auth.NewAuthConfig(username, password, email, p)
+
+	// Only store the credentials once the registry accepted them
+	status, err := auth.LoginIndex(authConfig, index, &http.Client{Transport: transport}, false)
+	if err != nil {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if err := os.MkdirAll(p, 0700); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if err := auth.SaveConfig(authConfig); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	out := map[string]string{
+		"status": strings.TrimSpace(status),
+	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+	host := vars["registry"]
+	if !validRegistryHost(host) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid registry: %s\n", host)
+		return
+	}
+	if host == publicIndexName {
+		host = ""
+	}
+
+	p := credentialsPath(c, host)
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "No credentials for %s\n", vars["registry"])
+		return
+	}
+	if err := os.RemoveAll(p); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
@@ -18,62 +18,293 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker"
 	"github.com/dotcloud/docker/registry"
 	"github.com/gorilla/mux"
+	"github.com/philips/go-systemd"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
+	"sync"
+	"time"
 )
 
+// Defaults of the container_dir and unit_target_format settings
 const ContainerDir = "/var/lib/containers/"
-const UnitTemplate = "/usr/lib/systemd/system/etcd@.service"
-const UnitTargetFormat = "/etc/systemd/system/etcd@%s.service"
+const UnitTargetFormat = "/etc/systemd/system/container-%s.service"
+
+// Containers used to be run by links to the etcd@ template named this way
+const LegacyUnitTargetFormat = "/etc/systemd/system/etcd@%s.service"
+
+var validContainerName = regexp.MustCompile(`^[A-Za-z0-9]+$`)
 
 type Context struct {
+	StatePath     string
 	Path          string
 	ContainerPath string
 	Registry      *registry.Registry
 	Graph         *docker.Graph
 	Repositories  *docker.TagStore
+	StorageDriver string
+
+	// GraphLock serializes changes to the graph. Layers of pulls that are
+	// still in progress are pinned, so that a prune can't remove them
+	// while they are untagged.
+	GraphLock sync.Mutex
+	pinned    map[string]int
+}
+
+// ContainerInfo is stored as {name}.json next to each container rootfs and
+// records what the container was created from.
+type ContainerInfo struct {
+	Image     string    `json:"image"`
+	ImageName string    `json:"image_name,omitempty"`
+	Created   time.Time `json:"created"`
+	Storage   string    `json:"storage"`
+	// Policy is what the layers were allowed to create in the rootfs
+	Policy *docker.ExtractPolicy `json:"policy,omitempty"`
+}
+
+func containerInfoPath(c *Context, name string) string {
+	return path.Join(c.ContainerPath, name+".json")
+}
+
+func loadContainerInfo(c *Context, name string) (*ContainerInfo, error) {
+	data, err := ioutil.ReadFile(containerInfoPath(c, name))
+	if err != nil {
+		return nil, err
+	}
+	info := &ContainerInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func saveContainerInfo(c *Context, name string, info *ContainerInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(containerInfoPath(c, name), data, 0600)
 }
 
 var context Context
 
-func pullImage(c *Context, imgId, registry string, token []string) error {
-	history, err := c.Registry.GetRemoteHistory(imgId, registry, token)
+// imagePins keep the images a pull, push or save works on from being pruned
+// until it is done with them.
+type imagePins struct {
+	c   *Context
+	ids []string
+}
+
+// add pins an image. GraphLock must be held.
+func (p *imagePins) add(id string) {
+	p.c.pinned[id]++
+	p.ids = append(p.ids, id)
+}
+
+func (p *imagePins) release() {
+	p.c.GraphLock.Lock()
+	defer p.c.GraphLock.Unlock()
+	for _, id := range p.ids {
+		if p.c.pinned[id]--; p.c.pinned[id] <= 0 {
+			delete(p.c.pinned, id)
+		}
+	}
+	p.ids = nil
+}
+
+// pinStored pins an image if it is stored and tells whether it is.
+func pinStored(c *Context, pins *imagePins, id string) bool {
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
+	if !c.Graph.Exists(id) {
+		return false
+	}
+	pins.add(id)
+	return true
+}
+
+// downloadLayer stores a layer in a temporary file under the graph, which
+// the caller removes.
+func downloadLayer(c *Context, layer io.Reader) (*os.File, error) {
+	dir := path.Join(c.Graph.Root, ":tmp:")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "layer")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, layer); err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// registerLayer adds a downloaded layer to the graph and pins it, unless
+// another pull stored it meanwhile.
+func registerLayer(c *Context, pins *imagePins, img *docker.Image, layer io.Reader) error {
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
+	if !c.Graph.Exists(img.ID) {
+		if err := c.Graph.Register(layer, false, img); err != nil {
+			return err
+		}
+	}
+	pins.add(img.ID)
+	return nil
+}
+
+// remoteLayer is an image of a pulled history that isn't stored yet.
+type remoteLayer struct {
+	img  *docker.Image
+	json []byte
+}
+
+// pullImage pulls an image and its history. The metadata of the layers
+// that aren't stored is fetched first, so that a pull without the space
+// for all of them fails before downloading any. Layers are checked against
+// the trust policy and the checksums the index lists for them. They are
+// downloaded without GraphLock and pinned once registered, so that images
+// can be deleted and saved while a pull runs.
+func pullImage(c *Context, reg *registry.Registry, imgId, endpoint string, token []string, trust *imageTrust, checksums map[string]string, pins *imagePins) error {
+	history, err := reg.GetRemoteHistory(imgId, endpoint, token)
 	if err != nil {
 		return err
 	}
 
-	// FIXME: Try to stream the images?
-	// FIXME: Launch the getRemoteImage() in goroutines
+	var (
+		missing []*remoteLayer
+		need    int64
+	)
 	for _, id := range history {
-		if !c.Graph.Exists(id) {
-			log.Printf("Pulling %s metadata\r\n", id)
-			imgJson, err := c.Registry.GetRemoteImageJSON(id, registry, token)
-			if err != nil {
-				// FIXME: Keep goging in case of error?
-				return err
-			}
-			img, err := docker.NewImgJSON(imgJson)
-			if err != nil {
-				return fmt.Errorf("Failed to parse json: %s", err)
+		if err := cancelled(); err != nil {
+			return err
+		}
+		if pinStored(c, pins, id) {
+			if trust.Policy != TrustOff {
+				if err := trust.enforce(id, verifyStoredSignature(c, trust.Keys, id)); err != nil {
+					return err
+				}
 			}
+			continue
+		}
 
-			// Get the layer
-			log.Printf("Pulling %s fs layer\r\n", img.ID)
-			layer, _, err := c.Registry.GetRemoteImageLayer(img.ID, registry, token)
-			if err != nil {
-				return err
-			}
-			if err := c.Graph.Register(layer, false, img); err != nil {
-				return err
-			}
+		log.Printf("Pulling %s metadata\r\n", id)
+		imgJson, err := reg.GetRemoteImageJSON(id, endpoint, token)
+		if err != nil {
+			// FIXME: Keep goging in case of error?
+			return err
+		}
+		img, err := docker.NewImgJSON(imgJson)
+		if err != nil {
+			return fmt.Errorf("Failed to parse json: %s", err)
+		}
+		missing = append(missing, &remoteLayer{img, imgJson})
+		need += img.Size
+	}
+	if err := checkSpace(c, c.Graph.Root, need); err != nil {
+		return err
+	}
+
+	// FIXME: Try to stream the images?
+	// FIXME: Launch the getRemoteImage() in goroutines
+	for _, l := range missing {
+		if err := cancelled(); err != nil {
+			return err
+		}
+		if err := pullLayer(c, reg, l, endpoint, token, trust, checksums[l.img.ID], pins); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullLayer downloads, checks and registers a layer of a pull.
+func pullLayer(c *Context, reg *registry.Registry, l *remoteLayer, endpoint string, token []string, trust *imageTrust, checksum string, pins *imagePins) error {
+	id := l.img.ID
+
+	var manifest, sig []byte
+	if trust.Policy != TrustOff {
+		var err error
+		sig, err = reg.GetRemoteImageSignature(id, endpoint, token)
+		if err == nil && checksum == "" {
+			err = fmt.Errorf("The index lists no checksum")
+		}
+		if err == nil {
+			manifest = imageManifest(id, checksum)
+			err = verifySignature(trust.Keys, manifest, sig)
+		}
+		if err != nil {
+			manifest, sig = nil, nil
+		}
+		if err := trust.enforce(id, err); err != nil {
+			return err
+		}
+	}
+
+	// Get the layer
+	log.Printf("Pulling %s fs layer\r\n", id)
+	layer, length, err := reg.GetRemoteImageLayer(id, endpoint, token)
+	if err != nil {
+		return err
+	}
+	stopWatching := closeOnCancel(layer)
+
+	// Registries that don't send the unpacked size get the compressed
+	// size checked at least
+	if l.img.Size == 0 && length > 0 {
+		if err := checkSpace(c, c.Graph.Root, int64(length)); err != nil {
+			stopWatching()
+			layer.Close()
+			return err
+		}
+	}
+
+	// The checksum covers the json and the layer as served. A layer cut
+	// short by a shutdown leaves nothing behind.
+	h := sha256.New()
+	h.Write(l.json)
+	h.Write([]byte("\n"))
+	f, err := downloadLayer(c, io.TeeReader(cancelReader{countingReader{layer}}, h))
+	stopWatching()
+	layer.Close()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); checksum != "" && sum != checksum {
+		err := fmt.Errorf("Checksum mismatch: got %s, expected %s", sum, checksum)
+		if trust.Policy == TrustOff {
+			log.Printf("Warning: %s: %s", id, err)
+		} else if err := trust.enforce(id, err); err != nil {
+			return err
 		}
+		manifest, sig = nil, nil
+	}
+
+	if err := registerLayer(c, pins, l.img, cancelReader{f}); err != nil {
+		return err
+	}
+	if manifest != nil {
+		return saveSignature(c, id, manifest, sig)
 	}
 	return nil
 }
@@ -81,29 +312,85 @@ func pullImage(c *Context, imgId, registry string, token []string) error {
 // TODO: add tag support
 func pullHandler(w http.ResponseWriter, r *http.Request, c *Context) {
 	vars := mux.Vars(r)
-	remote := vars["remote"]
+	local := vars["remote"]
 
-	repoData, err := c.Registry.GetRepositoryData(remote)
+	// Names like myreg.local:5000/app are pulled from that registry
+	host, remote := registry.ResolveRepositoryName(local)
+	reg, err := registryFor(c, host)
 	if err != nil {
-		log.Fatal(err)
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s\n", err)
+		return
 	}
 
-	tagsList, err := c.Registry.GetRemoteTags(repoData.Endpoints, remote, repoData.Tokens)
+	trust, err := loadImageTrust(c, local)
 	if err != nil {
-		log.Fatal(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	if err := beginOperation(); err != nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	defer endOperation()
+
+	start := time.Now()
+	result := "failed"
+	defer func() { observePull(result, time.Since(start)) }()
+
+	pins := &imagePins{c: c}
+	defer pins.release()
+
+	repoData, err := reg.GetRepositoryData(remote)
+	if err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	tagsList, err := reg.GetRemoteTags(repoData.Endpoints, remote, repoData.Tokens)
+	if err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "%s\n", err)
+		return
 	}
 
 	for tag, id := range tagsList {
-		repoData.ImgList[id].Tag = tag
+		if img, exists := repoData.ImgList[id]; exists {
+			img.Tag = tag
+		}
+	}
+
+	checksums := make(map[string]string)
+	for id, img := range repoData.ImgList {
+		checksums[id] = img.Checksum
 	}
 
 	for _, img := range repoData.ImgList {
-		log.Printf("Pulling image %s (%s) from %s\n", img.ID, img.Tag, remote)
+		log.Printf("Pulling image %s (%s) from %s\n", img.ID, img.Tag, local)
 		success := false
 
 		for _, ep := range repoData.Endpoints {
-			if err := pullImage(c, img.ID, "https://"+ep+"/v1", repoData.Tokens); err != nil {
-				fmt.Printf("Error while retrieving image for tag: %s; checking next endpoint\n", err)
+			err := pullImage(c, reg, img.ID, reg.EndpointURL(ep), repoData.Tokens, trust, checksums, pins)
+			if e, ok := err.(*UntrustedError); ok {
+				w.WriteHeader(403)
+				fmt.Fprintf(w, "%s\n", e)
+				return
+			}
+			if _, ok := err.(*SpaceError); ok {
+				writeOperationError(w, err)
+				return
+			}
+			if err != nil && cancelled() != nil {
+				w.WriteHeader(503)
+				fmt.Fprintf(w, "%s\n", errShuttingDown)
+				return
+			}
+			if err != nil {
+				log.Printf("Error while retrieving image for tag: %s; checking next endpoint\n", err)
 				continue
 			}
 			success = true
@@ -111,37 +398,70 @@ func pullHandler(w http.ResponseWriter, r *http.Request, c *Context) {
 		}
 
 		if !success {
-			log.Fatal("Could not find repository on any of the indexed registries.")
+			w.WriteHeader(502)
+			fmt.Fprintf(w, "Could not find image %s on any of the indexed registries.\n", img.ID)
+			return
 		}
 	}
 
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
 	for tag, id := range tagsList {
-		if err := c.Repositories.Set(remote, tag, id, true); err != nil {
-			log.Fatal(err)
+		if err := c.Repositories.Set(local, tag, id, true); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "%s\n", err)
 			return
 		}
 	}
 	if err := c.Repositories.Save(); err != nil {
-		log.Fatal(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
+	result = "ok"
 
 	fmt.Fprintf(w, "%v\n", repoData)
 }
 
+// lookupImage resolves a full image id, a unique prefix of one or a
+// "repo:tag" name to an image. TagStore.LookupImage splits on the first ':'
+// which breaks registry hosts with a port, so the name is split with
+// parseRepositoryTag instead. It returns nil if there is no such image.
+func lookupImage(c *Context, name string) (*docker.Image, error) {
+	if img, err := c.Graph.Get(name); err == nil {
+		return img, nil
+	}
+	repo, tag := parseRepositoryTag(name)
+	return c.Repositories.GetImage(repo, tag)
+}
+
 func createHandler(w http.ResponseWriter, r *http.Request, c *Context) {
 	imageName := r.FormValue("image")
+	if imageName == "" {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "Missing image\n")
+		return
+	}
 
-	// TODO: @philips Don't hardcode the tag name here
-	image, err := c.Repositories.GetImage(imageName, "latest")
+	image, err := lookupImage(c, imageName)
 	if err != nil {
-		log.Fatal(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
-
-	if imageName == "" {
+	if image == nil {
 		w.WriteHeader(404)
-		fmt.Fprintf(w, "Cannot find container image: %s", imageName)
+		fmt.Fprintf(w, "Cannot find container image: %s\n", imageName)
+		return
+	}
+
+	if err := verifyImage(c, image, imageName); err != nil {
+		if _, ok := err.(*UntrustedError); ok {
+			w.WriteHeader(403)
+		} else {
+			w.WriteHeader(500)
+		}
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
 
@@ -149,13 +469,40 @@ func createHandler(w http.ResponseWriter, r *http.Request, c *Context) {
 	vars := mux.Vars(r)
 	container := vars["container"]
 
-	validID := regexp.MustCompile(`^[A-Za-z0-9]+$`)
-	if !validID.MatchString(container) {
+	if !validContainerName.MatchString(container) {
 		w.WriteHeader(400)
 		fmt.Fprintf(w, "Invalid container name: %s\n", container)
 		return
 	}
 
+	overrides, err := parseUnitOverrides(r)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	policy, err := parseExtractPolicy(r)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	// The storage driver checks what it needs, this only refuses to
+	// create anything on a full disk
+	if err := checkSpace(c, c.ContainerPath, 0); err != nil {
+		writeOperationError(w, err)
+		return
+	}
+
+	if err := beginOperation(); err != nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	defer endOperation()
+
 	container = path.Join(c.ContainerPath, container)
 
 	err = os.Mkdir(container, 0700)
@@ -165,82 +512,131 @@ func createHandler(w http.ResponseWriter, r *http.Request, c *Context) {
 		return
 	}
 	if err != nil {
-		w.WriteHeader(400)
-		fmt.Fprint(w, "Error")
-		log.Fatal(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
 
-	var images []docker.Image
+	// A create stopped by a shutdown removes what it wrote like any
+	// other that fails
+	var driver string
+	fail := func(err error) {
+		log.Printf("Failed to create %s: %s", container, err)
+		if err := removeRootfs(c, driver, vars["container"], container); err != nil {
+			log.Printf("Failed to clean up %s: %s", container, err)
+		}
+		os.Remove(containerInfoPath(c, vars["container"]))
+		os.Remove(unitTarget(vars["container"]))
+		writeOperationError(w, err)
+	}
 
-	createList := func(img *docker.Image) (err error) {
-		images = append(images, *img)
+	driver, rejected, err := createRootfs(c, vars["container"], container, image, policy)
+	if err != nil {
+		fail(err)
 		return
 	}
-	err = image.WalkHistory(createList)
 
-	for i := len(images) - 1; i >= 0; i-- {
-		img := images[i]
-		log.Printf("Copying %s into %s", img.ID, container)
-		tarball, err := img.TarLayer(docker.Uncompressed)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-		if err := docker.Untar(tarball, container); err != nil {
-			log.Fatal(err)
-			return
-		}
+	info := &ContainerInfo{
+		Image:     image.ID,
+		ImageName: imageName,
+		Created:   time.Now(),
+		Storage:   driver,
+		Policy:    policy,
+	}
+	if err := saveContainerInfo(c, vars["container"], info); err != nil {
+		fail(err)
+		return
 	}
 
-	if err != nil {
-		log.Fatal(err)
+	// Write the unit file so it can be started
+	target := unitTarget(vars["container"])
+	unit := newUnitConfig(vars["container"], container, image, overrides)
+	if err := writeUnit(target, unit); err != nil {
+		fail(err)
 		return
 	}
 
-	// Symlink in the unit file so it can be started
-	target := fmt.Sprintf(UnitTargetFormat, vars["container"])
-	err = os.Symlink(UnitTemplate, target)
+	s := new(systemd.Systemd1)
+	defer s.Close()
+	if err := s.Connect(); err != nil {
+		log.Printf("Failed to connect to systemd: %s", err)
+	} else if err := s.Reload(); err != nil {
+		log.Printf("Failed to reload systemd: %s", err)
+	}
 
-	if err != nil {
-		fmt.Fprintf(w, "%s", err)
-		return
+	if rejected == nil {
+		rejected = []docker.Rejected{}
+	}
+	out := map[string]interface{}{
+		"container": vars["container"],
+		"storage":   driver,
+		"rejected":  rejected,
 	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
 
-	fmt.Fprint(w, "ok")
-	return
+// makeHandler passes the shared docker context to a handler.
+func makeHandler(fn func(http.ResponseWriter, *http.Request, *Context)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn(w, r, &context)
+	}
 }
 
 func setupDocker(r *mux.Router, o Options) {
-	// Use the /var/lib/containers directory by default
-	context.ContainerPath = path.Join(o.Dir, ContainerDir)
+	context.ContainerPath = path.Join(o.Dir, o.ContainerDir)
 	if err := os.MkdirAll(context.ContainerPath, 0700); err != nil && !os.IsExist(err) {
 		log.Fatal(err)
 		return
 	}
 	context.Registry = registry.NewRegistry(context.ContainerPath, nil)
 
+	context.StorageDriver = o.StorageDriver
+
 	// Put all docker images into the docker directory
-	context.Path = path.Join(o.Dir, StateDir, "docker")
+	context.StatePath = path.Join(o.Dir, o.StateDir)
+	context.Path = path.Join(o.Dir, o.StateDir, "docker")
 
 	p := path.Join(context.Path, "graph")
 	if err := os.MkdirAll(p, 0700); err != nil && !os.IsExist(err) {
 		log.Fatal(err)
 		return
 	}
+	// Layers a pull was writing when the daemon was killed are left in
+	// the temporary directory of the graph
+	if err := os.RemoveAll(path.Join(p, ":tmp:")); err != nil {
+		log.Printf("Failed to remove partial layers: %s", err)
+	}
 	g, _ := docker.NewGraph(p)
 	context.Graph = g
+	context.pinned = make(map[string]int)
 
 	p = path.Join(context.Path, "repositories")
 	t, _ := docker.NewTagStore(p, g)
 	context.Repositories = t
 
-	makeHandler := func(fn func(http.ResponseWriter, *http.Request, *Context)) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			fn(w, r, &context)
+	// Mounts of stacked container rootfs don't survive a reboot
+	if containers, err := listContainers(&context); err == nil {
+		for _, container := range containers {
+			if container.Info == nil {
+				continue
+			}
+			if err := mountRootfs(&context, container.Name, container.Info); err != nil {
+				log.Printf("Failed to mount %s: %s", container.Path, err)
+			}
 		}
 	}
 
-	r.HandleFunc("/registry/pull/{remote:.*}", makeHandler(pullHandler))
-	r.HandleFunc("/container/create/{container:.*}", makeHandler(createHandler))
+	r.HandleFunc("/registry/pull/{remote:.*}", makeHandler(pullHandler)).Name("pull")
+	r.HandleFunc("/registry/push/{name:.*}", makeHandler(pushHandler)).Methods("POST").Name("push")
+	r.HandleFunc("/registry/search", makeHandler(searchHandler)).Methods("GET").Name("search")
+	r.HandleFunc("/container/create/{container:.*}", makeHandler(createHandler)).Name("create")
+	r.HandleFunc("/auth", makeHandler(credentialsHandler)).Methods("GET").Name("credentials")
+	r.HandleFunc("/auth", makeHandler(loginHandler)).Methods("POST").Name("login")
+	r.HandleFunc("/auth/{registry}", makeHandler(logoutHandler)).Methods("DELETE").Name("logout")
+	r.HandleFunc("/images/prune", makeHandler(pruneHandler)).Methods("POST").Name("prune")
+	r.HandleFunc("/storage", makeHandler(storageHandler)).Methods("GET").Name("storage")
+	r.HandleFunc("/images/load", makeHandler(loadHandler)).Methods("POST").Name("load")
+	r.HandleFunc("/images/{name:.*}/save", makeHandler(saveHandler)).Methods("GET").Name("save")
+	r.HandleFunc("/images/{name:.*}", makeHandler(deleteImageHandler)).Methods("DELETE").Name("delete-image")
 }
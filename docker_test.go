@@ -0,0 +1,87 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLookupImage(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	loadTestImage(t, c)
+	if err := c.Repositories.Set("myreg.local:5000/app", "v1", testImageID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		found bool
+	}{
+		{testImageID, true},
+		{testImageID[:12], true},
+		{"app:v1", true},
+		{"app", false},
+		{"app:v2", false},
+		{"myreg.local:5000/app:v1", true},
+		{"myreg.local:5000/app", false},
+		{"fedcba98", false},
+	} {
+		img, err := lookupImage(c, test.name)
+		if err != nil {
+			t.Fatalf("Looking up %s: %s", test.name, err)
+		}
+		if found := img != nil; found != test.found {
+			t.Errorf("%s found: %v, want %v", test.name, found, test.found)
+		} else if found && img.ID != testImageID {
+			t.Errorf("%s is %s, want %s", test.name, img.ID, testImageID)
+		}
+	}
+}
+
+func TestCreateRefusals(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	loadTestImage(t, c)
+
+	// A create that isn't refused mustn't write to /etc
+	setLiveSettings(&liveSettings{UnitTemplate: unitTemplate, UnitTargetFormat: path.Join(dir, "container-%s.service")})
+	defer setLiveSettings(&liveSettings{})
+
+	for _, test := range []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{"web", url.Values{}, 400},
+		{"web", url.Values{"image": {"app:v2"}}, 404},
+		{"web", url.Values{"image": {"other"}}, 404},
+		{"web.1", url.Values{"image": {"app:v1"}}, 400},
+		{"web", url.Values{"image": {"app:v1"}, "restart": {"sometimes"}}, 400},
+		{"web", url.Values{"image": {"app:v1"}, "setuid": {"maybe"}}, 400},
+	} {
+		if w := create(c, test.name, test.form); w.Code != test.code {
+			t.Errorf("Creating %s with %v answered %d, want %d: %s", test.name, test.form, w.Code, test.code, w.Body)
+		}
+	}
+	if containers, err := listContainers(c); err != nil || len(containers) != 0 {
+		t.Fatalf("Refused creates left %v (%v)", containers, err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// parseRepositoryTag splits "repo:tag" into its parts. A ':' followed by a
+// '/' belongs to a registry host name and not to a tag, so "host:5000/app"
+// is the repository "host:5000/app" with the default tag.
+func parseRepositoryTag(name string) (string, string) {
+	n := strings.LastIndex(name, ":")
+	if n < 0 || strings.Contains(name[n+1:], "/") {
+		return name, docker.DEFAULTTAG
+	}
+	return name[:n], name[n+1:]
+}
+
+// imagesInUse returns the ids of the images that containers under
+// ContainerPath were created from, mapped to the container name.
+func imagesInUse(c *Context) (map[string]string, error) {
+	used := make(map[string]string)
+
+	dir, err := ioutil.ReadDir(c.ContainerPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range dir {
+		if !fi.IsDir() {
+			continue
+		}
+		info, err := loadContainerInfo(c, fi.Name())
+		if err != nil {
+			// Containers created before the metadata existed
+			continue
+		}
+		used[info.Image] = fi.Name()
+	}
+	return used, nil
+}
+
+// pruneImages deletes images that are not tagged, not the source of a
+// container, not the parent of another image and not pinned by a pull,
+// push or save. If only is not nil just the images with an id in it are
+// considered. Deleting an image can leave its parent unreferenced so this
+// repeats until nothing more is removed.
+func pruneImages(c *Context, only map[string]bool) ([]string, error) {
+	deleted := []string{}
+
+	for {
+		byParent, err := c.Graph.ByParent()
+		if err != nil {
+			return deleted, err
+		}
+		used, err := imagesInUse(c)
+		if err != nil {
+			return deleted, err
+		}
+		tagged := c.Repositories.ByID()
+
+		all, err := c.Graph.All()
+		if err != nil {
+			return deleted, err
+		}
+
+		removed := 0
+		for _, img := range all {
+			if only != nil && !only[img.ID] {
+				continue
+			}
+			if _, ok := tagged[img.ID]; ok {
+				continue
+			}
+			if _, ok := used[img.ID]; ok {
+				continue
+			}
+			if _, ok := byParent[img.ID]; ok {
+				continue
+			}
+			if c.pinned[img.ID] > 0 {
+				continue
+			}
+
+			log.Printf("Deleting image %s", img.ID)
+			if err := c.Graph.Delete(img.ID); err != nil {
+				return deleted, err
+			}
+			forgetLayerSize(img.ID)
+			if err := removeBtrfsBase(c, img.ID); err != nil {
+				log.Printf("Failed to remove btrfs base of %s: %s", img.ID, err)
+			}
+			deleted = append(deleted, img.ID)
+			removed++
+		}
+
+		if removed == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+func deleteImageHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+	repo, tag := parseRepositoryTag(vars["name"])
+
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
+
+	image, err := c.Repositories.GetImage(repo, tag)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if image == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find image: %s:%s\n", repo, tag)
+		return
+	}
+
+	used, err := imagesInUse(c)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	// Removing one of several tags of an image leaves it in place
+	if container, ok := used[image.ID]; ok && len(c.Repositories.ByID()[image.ID]) < 2 {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Image %s:%s is used by container %s\n", repo, tag, container)
+		return
+	}
+
+	if _, err := c.Repositories.Delete(repo, tag); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	// Only remove the layers of this image, other dangling images are
+	// left for an explicit prune.
+	history, err := image.History()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	only := make(map[string]bool)
+	for _, img := range history {
+		only[img.ID] = true
+	}
+
+	deleted, err := pruneImages(c, only)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	out := map[string]interface{}{
+		"untagged": repo + ":" + tag,
+		"deleted":  deleted,
+	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+func pruneHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
+
+	deleted, err := pruneImages(c, nil)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	out := map[string]interface{}{
+		"deleted": deleted,
+	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
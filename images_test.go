@@ -0,0 +1,104 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// loadTestImage loads testImageID tagged app:v1.
+func loadTestImage(t *testing.T, c *Context) {
+	tarball := testTarball(t, map[string][]byte{
+		testImageID + "/json":      []byte(fmt.Sprintf(`{"id": "%s"}`, testImageID)),
+		testImageID + "/layer.tar": testLayer(t),
+		"repositories":             []byte(fmt.Sprintf(`{"app": {"v1": "%s"}}`, testImageID)),
+	})
+	if w := serveTransfer(c, "POST", "/images/load", bytes.NewReader(tarball)); w.Code != 200 {
+		t.Fatalf("Load answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func deleteImage(c *Context, name string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/images/{name:.*}", func(w http.ResponseWriter, r *http.Request) {
+		deleteImageHandler(w, r, c)
+	}).Methods("DELETE")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/images/"+name, nil))
+	return w
+}
+
+func TestDeleteImageInUse(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	loadTestImage(t, c)
+
+	if err := os.Mkdir(path.Join(c.ContainerPath, "web"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveContainerInfo(c, "web", &ContainerInfo{Image: testImageID}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := deleteImage(c, "app:v1")
+	if w.Code != 409 {
+		t.Fatalf("Deleting an image in use answered %d: %s", w.Code, w.Body)
+	}
+	if !c.Graph.Exists(testImageID) {
+		t.Fatal("The image in use was deleted")
+	}
+	if img, err := c.Repositories.GetImage("app", "v1"); err != nil || img == nil {
+		t.Fatalf("app:v1 is %v (%v) after a refused delete", img, err)
+	}
+
+	// One of several tags can go
+	if err := c.Repositories.Set("app", "v2", testImageID, false); err != nil {
+		t.Fatal(err)
+	}
+	if w := deleteImage(c, "app:v2"); w.Code != 200 {
+		t.Fatalf("Deleting a second tag answered %d: %s", w.Code, w.Body)
+	}
+	if !c.Graph.Exists(testImageID) {
+		t.Fatal("Untagging deleted the image in use")
+	}
+
+	if err := os.RemoveAll(path.Join(c.ContainerPath, "web")); err != nil {
+		t.Fatal(err)
+	}
+	if w := deleteImage(c, "app:v1"); w.Code != 200 {
+		t.Fatalf("Deleting an unused image answered %d: %s", w.Code, w.Body)
+	}
+	if c.Graph.Exists(testImageID) {
+		t.Fatal("The unused image was kept")
+	}
+}
+
+func TestDeleteUnknownImage(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	if w := deleteImage(c, "app:v1"); w.Code != 404 {
+		t.Fatalf("Deleting an unknown image answered %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Sockets passed by systemd start at this descriptor
+const listenFdsStart = 3
+
+// activationListeners returns the sockets systemd passed with LISTEN_FDS,
+// if they are meant for this process.
+func activationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	// Keep the sockets from children such as systemd-nspawn
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Socket %d from systemd: %s", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// unixListener binds a Unix socket with the mode and group of the options,
+// replacing a socket left behind at the same path.
+func unixListener(o Options) (net.Listener, error) {
+	if fi, err := os.Lstat(o.UnixSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(o.UnixSocket)
+	}
+	l, err := net.Listen("unix", o.UnixSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(o); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setSocketPermissions(o Options) error {
+	mode, err := strconv.ParseUint(o.UnixMode, 8, 32)
+	if err == nil {
+		err = os.Chmod(o.UnixSocket, os.FileMode(mode))
+	}
+	if err == nil && o.UnixGroup != "" {
+		var group *user.Group
+		group, err = user.LookupGroup(o.UnixGroup)
+		if err == nil {
+			gid, _ := strconv.Atoi(group.Gid)
+			err = os.Chown(o.UnixSocket, -1, gid)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Setting up %s: %s", o.UnixSocket, err)
+	}
+	return nil
+}
+
+// Listeners are the sockets a server answers on: those passed by systemd,
+// or else the TCP port and Unix socket of the options.
+type Listeners struct {
+	sync.Mutex
+	server    *http.Server
+	tcp       net.Listener
+	unix      net.Listener
+	activated []net.Listener
+	closed    bool
+
+	// Errors of the sockets in use end up here
+	Errors chan error
+}
+
+func newListeners(server *http.Server) *Listeners {
+	return &Listeners{server: server, Errors: make(chan error, 1)}
+}
+
+// Open starts serving the sockets of the options.
+func (ls *Listeners) Open(o Options) error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	activated, err := activationListeners()
+	if err != nil {
+		return err
+	}
+	if activated != nil {
+		ls.activated = activated
+		for _, l := range activated {
+			ls.serve(l, o)
+		}
+		return nil
+	}
+
+	if o.Port == "" && o.UnixSocket == "" {
+		return fmt.Errorf("Nothing to listen on, give -p or -unix")
+	}
+	if o.Port != "" {
+		if ls.tcp, err = net.Listen("tcp", net.JoinHostPort(o.Address, o.Port)); err != nil {
+			return err
+		}
+		ls.serve(ls.tcp, o)
+	}
+	if o.UnixSocket != "" {
+		if ls.unix, err = unixListener(o); err != nil {
+			return err
+		}
+		ls.serve(ls.unix, o)
+	}
+	return nil
+}
+
+// Update moves to the sockets of o from those of old. Every new socket is
+// bound before any old one is closed, so that a failure leaves the sockets
+// of old in use, and closing a socket leaves the connections it accepted
+// to finish. Sockets passed by systemd stay.
+func (ls *Listeners) Update(old, o Options) error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if ls.closed {
+		return fmt.Errorf("Shutting down")
+	}
+	if ls.activated != nil {
+		return nil
+	}
+	if o.Port == "" && o.UnixSocket == "" {
+		return fmt.Errorf("Nothing to listen on, give a port or a Unix socket")
+	}
+
+	tcpChanged := o.Address != old.Address || o.Port != old.Port
+	unixChanged := o.UnixSocket != old.UnixSocket
+	var tcp, unix net.Listener
+	abort := func(err error) error {
+		for _, l := range []net.Listener{tcp, unix} {
+			if l != nil {
+				l.Close()
+			}
+		}
+		return err
+	}
+
+	var err error
+	if tcpChanged && o.Port != "" {
+		if tcp, err = net.Listen("tcp", net.JoinHostPort(o.Address, o.Port)); err != nil {
+			return abort(err)
+		}
+	}
+	if unixChanged && o.UnixSocket != "" {
+		if unix, err = unixListener(o); err != nil {
+			return abort(err)
+		}
+	} else if !unixChanged && o.UnixSocket != "" && (o.UnixMode != old.UnixMode || o.UnixGroup != old.UnixGroup) {
+		if err := setSocketPermissions(o); err != nil {
+			return abort(err)
+		}
+	}
+
+	if tcpChanged {
+		if ls.tcp != nil {
+			ls.tcp.Close()
+		}
+		ls.tcp = tcp
+		if tcp != nil {
+			ls.serve(tcp, o)
+		}
+	}
+	if unixChanged {
+		if ls.unix != nil {
+			ls.unix.Close()
+		}
+		ls.unix = unix
+		if unix != nil {
+			ls.serve(unix, o)
+		}
+	}
+	return nil
+}
+
+// Close closes every socket, which removes the Unix socket.
+func (ls *Listeners) Close() {
+	ls.Lock()
+	defer ls.Unlock()
+
+	for _, l := range append([]net.Listener{ls.tcp, ls.unix}, ls.activated...) {
+		if l != nil {
+			l.Close()
+		}
+	}
+	ls.tcp, ls.unix, ls.activated = nil, nil, nil
+	ls.closed = true
+}
+
+// Shutdown closes every socket and waits for the requests in progress to
+// finish, or for ctx to end.
+func (ls *Listeners) Shutdown(ctx gocontext.Context) error {
+	ls.Close()
+	return ls.server.Shutdown(ctx)
+}
+
+// serve answers on l, with TLS on TCP sockets when it is configured. Unix
+// sockets are left to file permissions.
+func (ls *Listeners) serve(l net.Listener, o Options) {
+	useTLS := o.TLSCert != "" && l.Addr().Network() != "unix"
+	go func() {
+		var err error
+		if useTLS {
+			err = ls.server.ServeTLS(l, "", "")
+		} else {
+			err = ls.server.Serve(l)
+		}
+
+		// Sockets closed by Update or Close are not errors
+		ls.Lock()
+		inUse := l == ls.tcp || l == ls.unix
+		for _, a := range ls.activated {
+			inUse = inUse || l == a
+		}
+		ls.Unlock()
+		if inUse {
+			select {
+			case ls.Errors <- err:
+			default:
+			}
+		}
+	}()
+}
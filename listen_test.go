@@ -0,0 +1,74 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestListenersUpdateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd-rest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ls := newListeners(&http.Server{})
+	defer ls.Close()
+	old := Options{Address: "127.0.0.1", Port: freePort(t), UnixMode: "0660"}
+	if err := ls.Open(old); err != nil {
+		t.Fatal(err)
+	}
+	oldAddr := ls.tcp.Addr().String()
+
+	// The Unix socket can't be bound, so the new port mustn't be either
+	o := old
+	o.Port = freePort(t)
+	o.UnixSocket = path.Join(dir, "missing", "sock")
+	if err := ls.Update(old, o); err == nil {
+		t.Fatal("Binding a socket in a missing directory succeeded")
+	}
+	if addr := ls.tcp.Addr().String(); addr != oldAddr {
+		t.Fatalf("Listening on %s after a failed update, want %s", addr, oldAddr)
+	}
+
+	o.UnixSocket = path.Join(dir, "sock")
+	if err := ls.Update(old, o); err != nil {
+		t.Fatalf("Updating again: %s", err)
+	}
+	if _, port, _ := net.SplitHostPort(ls.tcp.Addr().String()); port != o.Port {
+		t.Fatalf("Listening on %s, want port %s", ls.tcp.Addr(), o.Port)
+	}
+	if ls.unix == nil {
+		t.Fatal("The Unix socket isn't in use")
+	}
+}
@@ -17,43 +17,131 @@
 package main
 
 import (
-	"flag"
+	"crypto/tls"
+	"github.com/dotcloud/docker"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-type Options struct {
-	Dir  string
-	Port string
-}
-
-var options = Options{}
+// reload reads the settings again and applies them to the requests and
+// connections that follow, leaving those in progress alone. Nothing
+// changes unless all of them are valid.
+func reload(r *mux.Router, listeners *Listeners) error {
+	o, err := readOptions(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	for _, name := range restartOnly(options, &o) {
+		log.Printf("The %s setting changes at the next restart", name)
+	}
 
-func init() {
-	const (
-		defaultDir  = "/"
-		defaultPort = "8080"
-	)
+	settings, err := newLiveSettings(o)
+	if err != nil {
+		return err
+	}
+	roles, err := loadClientRoles(o.ClientRoles)
+	if err != nil {
+		return err
+	}
+	rules, err := loadAuthPolicy(o.AuthPolicy, r)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if o.TLSCert != "" {
+		if tlsConfig, err = newTLSConfig(o); err != nil {
+			return err
+		}
+	}
 
-	flag.StringVar(&options.Dir, "D", defaultDir, "Directory prefix (default /)")
-	flag.StringVar(&options.Port, "p", defaultPort, "Port to bind to")
+	if err := listeners.Update(options, o); err != nil {
+		return err
+	}
+	setLiveSettings(settings)
+	setClientRoles(roles)
+	setAuthPolicy(rules)
+	if tlsConfig != nil {
+		setTLSConfig(tlsConfig)
+	}
+	options = o
+	return nil
 }
 
-const StateDir = "/var/lib/systemd-rest/"
+// reloadOnHangup reloads the settings on SIGHUP. Invalid settings are
+// logged and the previous ones stay in force.
+func reloadOnHangup(r *mux.Router, listeners *Listeners) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		sdNotify("RELOADING=1")
+		if err := reload(r, listeners); err != nil {
+			log.Printf("Keeping the previous settings: %s", err)
+		} else {
+			log.Printf("Reloaded the settings")
+		}
+		sdNotify("READY=1")
+	}
+}
 
 func main() {
-	flag.Parse()
+	o, err := readOptions(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	options = o
+	docker.Bsdtar = options.Extractor == ExtractorBsdtar
+
+	settings, err := newLiveSettings(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setLiveSettings(settings)
+	roles, err := loadClientRoles(options.ClientRoles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setClientRoles(roles)
 
 	r := mux.NewRouter()
 
 	setupUnits(r.PathPrefix("/units").Subrouter(), options)
 	setupDocker(r.PathPrefix("/docker").Subrouter(), options)
+	setupContainers(r.PathPrefix("/containers").Subrouter(), options)
 	setupUpdate(r.PathPrefix("/update").Subrouter(), options)
+	setupAudit(options)
+	r.HandleFunc("/audit", auditHandler).Methods("GET").Name("audit")
+	setupMetrics(r)
 
-	http.Handle("/", r)
-	err := http.ListenAndServe(":"+options.Port, nil)
+	rules, err := loadAuthPolicy(options.AuthPolicy, r)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal(err)
+	}
+	setAuthPolicy(rules)
+
+	http.Handle("/", instrument(r, audit(r, authorize(r))))
+	server := &http.Server{}
+	if options.TLSCert != "" {
+		tlsConfig, err := newTLSConfig(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setTLSConfig(tlsConfig)
+		server.TLSConfig = liveTLSConfig()
 	}
+
+	listeners := newListeners(server)
+	if err := listeners.Open(options); err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	go shutdownOnTerm(server, listeners)
+	go reloadOnHangup(r, listeners)
+
+	sdNotify("READY=1")
+	go watchdog()
+
+	log.Fatal("Serve: ", <-listeners.Errors)
 }
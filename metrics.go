@@ -0,0 +1,307 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/philips/go-systemd"
+	"io"
+	"launchpad.net/go-dbus"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket bounds in seconds of the latency histograms
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	pullBuckets    = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// histogram counts observations into buckets the way Prometheus expects.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write adds the histogram as name with labels, which are given as
+// name="value" pairs joined by commas.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := labels
+	if sep != "" {
+		sep += ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, sep, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label formats name="value" pairs from alternating names and values.
+func label(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metrics are kept by label set, which is formatted once when it is first
+// seen.
+var metrics = struct {
+	sync.Mutex
+	requests         map[string]uint64
+	requestDurations map[string]*histogram
+	dbusCalls        map[string]*histogram
+	dbusErrors       map[string]uint64
+	pullBytes        uint64
+	pullDurations    map[string]*histogram
+}{
+	requests:         map[string]uint64{},
+	requestDurations: map[string]*histogram{},
+	dbusCalls:        map[string]*histogram{},
+	dbusErrors:       map[string]uint64{},
+	pullDurations:    map[string]*histogram{},
+}
+
+func observeHistogram(m map[string]*histogram, labels string, bounds []float64, v float64) {
+	h, exists := m[labels]
+	if !exists {
+		h = newHistogram(bounds)
+		m[labels] = h
+	}
+	h.observe(v)
+}
+
+func observeRequest(route, method string, status int, duration time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.requests[label("route", route, "method", method, "code", strconv.Itoa(status))]++
+	observeHistogram(metrics.requestDurations, label("route", route), latencyBuckets, duration.Seconds())
+}
+
+func observeDbus(iface, method string, duration time.Duration, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	labels := label("interface", iface, "method", method)
+	observeHistogram(metrics.dbusCalls, labels, latencyBuckets, duration.Seconds())
+	if err != nil {
+		metrics.dbusErrors[labels]++
+	}
+}
+
+func observePull(result string, duration time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	observeHistogram(metrics.pullDurations, label("result", result), pullBuckets, duration.Seconds())
+}
+
+// countingReader adds what is read through it to the bytes pulled.
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	metrics.Lock()
+	metrics.pullBytes += uint64(n)
+	metrics.Unlock()
+	return n, err
+}
+
+// callDbus calls a method of obj and records how long it took and whether
+// it failed.
+func callDbus(obj *dbus.ObjectProxy, iface, method string, args ...interface{}) (*dbus.Message, error) {
+	start := time.Now()
+	reply, err := obj.Call(iface, method, args...)
+	observeDbus(iface, method, time.Since(start), err)
+	return reply, err
+}
+
+// requestMethod returns the method a request is counted under. Methods
+// the routes don't use are counted together, so that clients can't add
+// label values at will.
+func requestMethod(r *http.Request) string {
+	switch r.Method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS":
+		return r.Method
+	}
+	return "other"
+}
+
+// instrument wraps handler, which serves the routes of router, so that
+// requests are counted and timed by route name.
+func instrument(router *mux.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "none"
+		var match mux.RouteMatch
+		if router.Match(r, &match) {
+			route = match.Route.GetName()
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = 200
+		}
+		observeRequest(route, requestMethod(r), rec.status, time.Since(start))
+	})
+}
+
+func writeSamples(w io.Writer, name string, samples map[string]uint64) {
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, braces(key), samples[key])
+	}
+}
+
+func writeHistograms(w io.Writer, name string, histograms map[string]*histogram) {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		histograms[key].write(w, name, key)
+	}
+}
+
+// writeGraphSize adds the size of the layers stored in the graph, as
+// recorded when they were registered. Pulls in progress don't hold it up,
+// their layers show once registered.
+func writeGraphSize(w io.Writer, c *Context) {
+	images, err := c.Graph.All()
+	if err != nil {
+		log.Printf("Metrics: %s", err)
+		return
+	}
+	var size int64
+	for _, img := range images {
+		if s, err := layerSize(c, img); err == nil {
+			size += s
+		}
+	}
+	writeHeader(w, "systemd_rest_graph_images", "gauge", "Images stored in the graph.")
+	fmt.Fprintf(w, "systemd_rest_graph_images %d\n", len(images))
+	writeHeader(w, "systemd_rest_graph_bytes", "gauge", "Bytes of the layers stored in the graph.")
+	fmt.Fprintf(w, "systemd_rest_graph_bytes %d\n", size)
+}
+
+// writeUnitStates adds the number of units in each active state, as
+// listed by systemd at the time of the scrape.
+func writeUnitStates(w io.Writer) {
+	s := new(systemd.Systemd1)
+	defer s.Close()
+	if err := s.Connect(); err != nil {
+		log.Printf("Metrics: %s", err)
+		return
+	}
+	units, err := s.ListUnits()
+	if err != nil {
+		log.Printf("Metrics: %s", err)
+		return
+	}
+
+	states := map[string]uint64{}
+	for _, unit := range units {
+		states[label("active_state", unit.ActiveState)]++
+	}
+	writeHeader(w, "systemd_rest_units", "gauge", "Units known to systemd, by active state.")
+	writeSamples(w, "systemd_rest_units", states)
+}
+
+// metricsHandler answers with the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	var buf bytes.Buffer
+
+	// The samples that need systemd or the disk are taken before the
+	// metrics are locked, as D-Bus calls record metrics themselves
+	writeUnitStates(&buf)
+	writeGraphSize(&buf, c)
+
+	metrics.Lock()
+	writeHeader(&buf, "systemd_rest_requests_total", "counter", "Requests served, by route, method and status.")
+	writeSamples(&buf, "systemd_rest_requests_total", metrics.requests)
+	writeHeader(&buf, "systemd_rest_request_duration_seconds", "histogram", "Time taken to serve requests, by route.")
+	writeHistograms(&buf, "systemd_rest_request_duration_seconds", metrics.requestDurations)
+	writeHeader(&buf, "systemd_rest_dbus_call_duration_seconds", "histogram", "Time taken by D-Bus method calls.")
+	writeHistograms(&buf, "systemd_rest_dbus_call_duration_seconds", metrics.dbusCalls)
+	writeHeader(&buf, "systemd_rest_dbus_call_errors_total", "counter", "D-Bus method calls that failed.")
+	writeSamples(&buf, "systemd_rest_dbus_call_errors_total", metrics.dbusErrors)
+	writeHeader(&buf, "systemd_rest_pull_bytes_total", "counter", "Bytes of layers downloaded by pulls.")
+	fmt.Fprintf(&buf, "systemd_rest_pull_bytes_total %d\n", metrics.pullBytes)
+	writeHeader(&buf, "systemd_rest_pull_duration_seconds", "histogram", "Time taken by pulls, by result.")
+	writeHistograms(&buf, "systemd_rest_pull_duration_seconds", metrics.pullDurations)
+	metrics.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(w)
+}
+
+func setupMetrics(r *mux.Router) {
+	systemd.Observe = observeDbus
+	r.HandleFunc("/metrics", makeHandler(metricsHandler)).Methods("GET").Name("metrics")
+}
@@ -0,0 +1,54 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInstrumentMethods(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/test-methods", func(http.ResponseWriter, *http.Request) {}).Name("test-methods")
+	handler := instrument(r, r)
+
+	// The counters are global, so only what this run adds is checked
+	counts := func() map[string]uint64 {
+		metrics.Lock()
+		defer metrics.Unlock()
+		out := make(map[string]uint64)
+		for _, method := range []string{"GET", "other", "BREW", "WHEN"} {
+			labels := label("route", "test-methods", "method", method, "code", "200")
+			out[method] = metrics.requests[labels]
+		}
+		return out
+	}
+	before := counts()
+
+	for _, method := range []string{"GET", "BREW", "WHEN", "GET"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/test-methods", nil))
+	}
+
+	after := counts()
+	for method, want := range map[string]uint64{"GET": 2, "other": 2, "BREW": 0, "WHEN": 0} {
+		if got := after[method] - before[method]; got != want {
+			t.Errorf("The method %s counted %d requests, want %d", method, got, want)
+		}
+	}
+}
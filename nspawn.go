@@ -0,0 +1,213 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// UnitTemplate is the unit written for every container. The container runs
+// under systemd-nspawn with the image config translated into arguments.
+const UnitTemplate = `[Unit]
+Description=Container {{.Name}}
+After=network.target
+
+[Service]
+ExecStart=/usr/bin/systemd-nspawn --quiet --machine={{.Name}} -D {{quote .Root}}{{range .Args}} {{quote .}}{{end}}{{if .Cmd}} --{{range .Cmd}} {{quote .}}{{end}}{{end}}
+KillMode=mixed
+Restart={{.Restart}}
+{{if .MemoryLimit}}MemoryLimit={{.MemoryLimit}}
+{{end}}{{if .CPUShares}}CPUShares={{.CPUShares}}
+{{end}}
+[Install]
+WantedBy=multi-user.target
+`
+
+var unitTemplate = template.Must(newUnitTemplate(UnitTemplate))
+
+// newUnitTemplate parses a unit template, which can quote arguments with
+// the quote function.
+func newUnitTemplate(text string) (*template.Template, error) {
+	return template.New("unit").Funcs(template.FuncMap{
+		"quote": unitQuote,
+	}).Parse(text)
+}
+
+var restartPolicies = []string{
+	"no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always",
+}
+
+// UnitOverrides are the settings a caller can pass along with the image
+// when creating a container.
+type UnitOverrides struct {
+	Restart    string
+	Binds      []string
+	Memory     int64
+	CpuShares  int64
+	WorkingDir string
+}
+
+// UnitConfig holds everything that goes into the unit of a container.
+type UnitConfig struct {
+	Name        string
+	Root        string
+	Args        []string
+	Cmd         []string
+	Restart     string
+	MemoryLimit int64
+	CPUShares   int64
+}
+
+// unitQuote quotes a word for an ExecStart= line so that neither spaces nor
+// systemd's % specifiers and $ variables are interpreted.
+func unitQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	s = strings.Replace(s, "%", "%%", -1)
+	s = strings.Replace(s, "$", "$$", -1)
+	return `"` + s + `"`
+}
+
+func parseUnitOverrides(r *http.Request) (*UnitOverrides, error) {
+	o := &UnitOverrides{
+		Restart: "no",
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+
+	if restart := r.FormValue("restart"); restart != "" {
+		valid := false
+		for _, p := range restartPolicies {
+			if restart == p {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid restart policy: %s", restart)
+		}
+		o.Restart = restart
+	}
+
+	for _, bind := range r.Form["bind"] {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw") {
+			return nil, fmt.Errorf("Invalid bind mount: %s (expected src:dst[:ro])", bind)
+		}
+		if !path.IsAbs(parts[0]) || !path.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("Bind mount paths must be absolute: %s", bind)
+		}
+		if strings.ContainsAny(bind, "\n\r") {
+			return nil, fmt.Errorf("Invalid bind mount: %q", bind)
+		}
+		o.Binds = append(o.Binds, bind)
+	}
+
+	if memory := r.FormValue("memory"); memory != "" {
+		m, err := strconv.ParseInt(memory, 10, 64)
+		if err != nil || m < 0 {
+			return nil, fmt.Errorf("Invalid memory limit: %s", memory)
+		}
+		o.Memory = m
+	}
+
+	if shares := r.FormValue("cpu_shares"); shares != "" {
+		s, err := strconv.ParseInt(shares, 10, 64)
+		if err != nil || s < 0 {
+			return nil, fmt.Errorf("Invalid cpu shares: %s", shares)
+		}
+		o.CpuShares = s
+	}
+
+	if workdir := r.FormValue("workdir"); workdir != "" {
+		if !path.IsAbs(workdir) {
+			return nil, fmt.Errorf("Working directory must be absolute: %s", workdir)
+		}
+		o.WorkingDir = workdir
+	}
+
+	return o, nil
+}
+
+// newUnitConfig translates the config of an image and the overrides of
+// the caller into nspawn arguments and unit settings.
+func newUnitConfig(name, root string, img *docker.Image, o *UnitOverrides) *UnitConfig {
+	u := &UnitConfig{
+		Name:    name,
+		Root:    root,
+		Restart: o.Restart,
+	}
+
+	if config := img.Config; config != nil {
+		if config.User != "" {
+			u.Args = append(u.Args, "--user="+config.User)
+		}
+		for _, env := range config.Env {
+			u.Args = append(u.Args, "--setenv="+env)
+		}
+		if len(config.PortSpecs) > 0 {
+			// Port forwarding needs a private network
+			u.Args = append(u.Args, "--network-veth")
+			for _, port := range config.PortSpecs {
+				u.Args = append(u.Args, "--port="+port)
+			}
+		}
+		u.Cmd = config.Cmd
+		u.MemoryLimit = config.Memory
+		u.CPUShares = config.CpuShares
+	}
+
+	// The docker config of this era has no WorkingDir, so only the caller
+	// can set one.
+	if o.WorkingDir != "" {
+		u.Args = append(u.Args, "--chdir="+o.WorkingDir)
+	}
+	for _, bind := range o.Binds {
+		if strings.HasSuffix(bind, ":ro") {
+			u.Args = append(u.Args, "--bind-ro="+strings.TrimSuffix(bind, ":ro"))
+		} else {
+			u.Args = append(u.Args, "--bind="+strings.TrimSuffix(bind, ":rw"))
+		}
+	}
+	if o.Memory != 0 {
+		u.MemoryLimit = o.Memory
+	}
+	if o.CpuShares != 0 {
+		u.CPUShares = o.CpuShares
+	}
+
+	return u
+}
+
+// writeUnit renders the unit of a container to target.
+func writeUnit(target string, u *UnitConfig) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return settings().UnitTemplate.Execute(f, u)
+}
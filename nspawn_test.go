@@ -0,0 +1,112 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/dotcloud/docker"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnitQuote(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+	}{
+		{"", `""`},
+		{"/bin/sh", `"/bin/sh"`},
+		{"echo hello world", `"echo hello world"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir`, `"C:\\dir"`},
+		{"--setenv=HOME=$HOME", `"--setenv=HOME=$$HOME"`},
+		{"100%", `"100%%"`},
+		{"a\nExecStartPre=/bin/rm", `"a\nExecStartPre=/bin/rm"`},
+	} {
+		if out := unitQuote(test.in); out != test.out {
+			t.Errorf("unitQuote(%q) is %s, want %s", test.in, out, test.out)
+		}
+	}
+}
+
+func TestParseUnitOverrides(t *testing.T) {
+	for _, test := range []struct {
+		form  url.Values
+		valid bool
+	}{
+		{url.Values{}, true},
+		{url.Values{"restart": {"on-failure"}}, true},
+		{url.Values{"restart": {"sometimes"}}, false},
+		{url.Values{"bind": {"/srv:/srv"}}, true},
+		{url.Values{"bind": {"/srv:/srv:ro"}}, true},
+		{url.Values{"bind": {"/srv"}}, false},
+		{url.Values{"bind": {"/srv:/srv:rx"}}, false},
+		{url.Values{"bind": {"srv:/srv"}}, false},
+		{url.Values{"bind": {"/srv:/srv\nExecStartPre=/bin/rm"}}, false},
+		{url.Values{"memory": {"1048576"}}, true},
+		{url.Values{"memory": {"-1"}}, false},
+		{url.Values{"memory": {"1M"}}, false},
+		{url.Values{"cpu_shares": {"-5"}}, false},
+		{url.Values{"workdir": {"/srv"}}, true},
+		{url.Values{"workdir": {"srv"}}, false},
+	} {
+		r := httptest.NewRequest("POST", "/docker/container/create/app", strings.NewReader(test.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, err := parseUnitOverrides(r)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("Overrides %v valid: %v (%v), want %v", test.form, valid, err, test.valid)
+		}
+	}
+}
+
+func TestUnitRendering(t *testing.T) {
+	img := &docker.Image{Config: &docker.Config{
+		User:      "nobody",
+		Env:       []string{"GREETING=hello world", "PRICE=$5"},
+		PortSpecs: []string{"80"},
+		Cmd:       []string{"/bin/sh", "-c", `echo "100%"`},
+		Memory:    1024,
+	}}
+	o := &UnitOverrides{Restart: "always", Binds: []string{"/srv:/data:ro"}, CpuShares: 512}
+
+	var b bytes.Buffer
+	if err := unitTemplate.Execute(&b, newUnitConfig("app", "/containers/app", img, o)); err != nil {
+		t.Fatal(err)
+	}
+	unit := b.String()
+	for _, line := range []string{
+		`ExecStart=/usr/bin/systemd-nspawn --quiet --machine=app -D "/containers/app" "--user=nobody" "--setenv=GREETING=hello world" "--setenv=PRICE=$$5" "--network-veth" "--port=80" "--bind-ro=/srv:/data" -- "/bin/sh" "-c" "echo \"100%%\""`,
+		"Restart=always",
+		"MemoryLimit=1024",
+		"CPUShares=512",
+	} {
+		if !strings.Contains(unit, line+"\n") {
+			t.Errorf("The unit lacks %s:\n%s", line, unit)
+		}
+	}
+}
+
+func TestContainerUnitTarget(t *testing.T) {
+	setLiveSettings(&liveSettings{UnitTemplate: unitTemplate, UnitTargetFormat: "/nonexistent/container-%s.service"})
+	defer setLiveSettings(&liveSettings{UnitTemplate: unitTemplate, UnitTargetFormat: UnitTargetFormat})
+
+	// Without a legacy link new containers get the current name
+	if target := containerUnitTarget("systemd-rest-test-none"); target != "/nonexistent/container-systemd-rest-test-none.service" {
+		t.Fatalf("The unit of a new container is %s", target)
+	}
+}
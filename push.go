@@ -0,0 +1,166 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*  Copyright 2013 Docker Authors
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/registry"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+)
+
+// pushImageList returns the tagged image and its history with checksums,
+// root first, as the index expects it. The images are pinned. GraphLock
+// must be held.
+func pushImageList(c *Context, pins *imagePins, local, tag string) (*docker.Image, []*registry.ImgData, error) {
+	image, err := c.Repositories.GetImage(local, tag)
+	if err != nil || image == nil {
+		return nil, nil, err
+	}
+
+	var imgList []*registry.ImgData
+	err = image.WalkHistory(func(img *docker.Image) error {
+		checksum, err := img.Checksum()
+		if err != nil {
+			return err
+		}
+		pins.add(img.ID)
+		imgList = append([]*registry.ImgData{{
+			ID:       img.ID,
+			Checksum: checksum,
+			Tag:      tag,
+		}}, imgList...)
+		return nil
+	})
+	return image, imgList, err
+}
+
+// pushImage uploads the json and layer of an image unless the registry
+// already has it. It returns whether anything was uploaded.
+func pushImage(c *Context, reg *registry.Registry, imgData *registry.ImgData, ep string, token []string) (bool, error) {
+	jsonRaw, err := ioutil.ReadFile(path.Join(c.Graph.Root, imgData.ID, "json"))
+	if err != nil {
+		return false, fmt.Errorf("Error while retreiving the path for {%s}: %s", imgData.ID, err)
+	}
+
+	if err := reg.PushImageJSONRegistry(imgData, jsonRaw, ep, token); err != nil {
+		if err == registry.ErrAlreadyExists {
+			log.Printf("Image %s already uploaded; skipping", imgData.ID)
+			return false, nil
+		}
+		return false, err
+	}
+
+	log.Printf("Pushing %s fs layer", imgData.ID)
+	layerData, err := c.Graph.TempLayerArchive(imgData.ID, docker.Gzip, ioutil.Discard)
+	if err != nil {
+		return false, fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+	defer layerData.Close()
+
+	if err := reg.PushImageLayerRegistry(imgData.ID, layerData, ep, token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// pushHandler pushes a tagged image to the registry named in the
+// repository, or to the public index.
+func pushHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+	local, tag := parseRepositoryTag(vars["name"])
+
+	// The layers are pinned rather than locked while they upload, so that
+	// the tag can be deleted meanwhile but the layers stay until pushed
+	pins := &imagePins{c: c}
+	defer pins.release()
+
+	c.GraphLock.Lock()
+	image, imgList, err := pushImageList(c, pins, local, tag)
+	c.GraphLock.Unlock()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if image == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find image: %s:%s\n", local, tag)
+		return
+	}
+
+	host, remote := registry.ResolveRepositoryName(local)
+	if authConfig, err := loadCredentials(c, host); err != nil || authConfig == nil {
+		w.WriteHeader(401)
+		fmt.Fprint(w, "Please login first\n")
+		return
+	}
+	reg, err := registryFor(c, host)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	repoData, err := reg.PushImageJSONIndex(remote, imgList, false)
+	if err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	pushed := []string{}
+	for _, ep := range repoData.Endpoints {
+		log.Printf("Pushing repository %s:%s to %s", local, tag, ep)
+		for _, elem := range imgList {
+			uploaded, err := pushImage(c, reg, elem, ep, repoData.Tokens)
+			if err != nil {
+				w.WriteHeader(502)
+				fmt.Fprintf(w, "%s\n", err)
+				return
+			}
+			if uploaded {
+				pushed = append(pushed, elem.ID)
+			}
+		}
+		if err := reg.PushRegistryTag(remote, image.ID, tag, ep, repoData.Tokens); err != nil {
+			w.WriteHeader(502)
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+	}
+
+	if _, err := reg.PushImageJSONIndex(remote, imgList, true); err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	out := map[string]interface{}{
+		"id":     image.ID,
+		"tag":    local + ":" + tag,
+		"pushed": pushed,
+	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
@@ -0,0 +1,51 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func push(c *Context, name string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/registry/push/{name:.*}", func(w http.ResponseWriter, r *http.Request) {
+		pushHandler(w, r, c)
+	}).Methods("POST")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/registry/push/"+name, nil))
+	return w
+}
+
+func TestPushRefusals(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	loadTestImage(t, c)
+
+	if w := push(c, "app:v2"); w.Code != 404 {
+		t.Fatalf("Pushing an unknown image answered %d: %s", w.Code, w.Body)
+	}
+	if w := push(c, "app:v1"); w.Code != 401 {
+		t.Fatalf("Pushing without credentials answered %d: %s", w.Code, w.Body)
+	}
+	if len(c.pinned) != 0 {
+		t.Fatalf("Images still pinned after refused pushes: %v", c.pinned)
+	}
+}
@@ -0,0 +1,451 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/go-dbus"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// update_engine reports this once an update is installed
+const updateNeedReboot = "UPDATE_STATUS_UPDATED_NEED_REBOOT"
+
+// The host is rebooted through logind
+const (
+	logindDest  = "org.freedesktop.login1"
+	logindPath  = dbus.ObjectPath("/org/freedesktop/login1")
+	logindIface = "org.freedesktop.login1.Manager"
+)
+
+const (
+	// The status is checked this often besides on StatusUpdate signals
+	rebootCheckInterval = time.Minute
+	// Reconnect to update_engine this long after losing it
+	rebootRetryInterval = 30 * time.Second
+)
+
+// ErrLockHeld means every slot of the reboot lock is taken.
+var ErrLockHeld = errors.New("The reboot lock is held by other machines")
+
+// LockStatus lists the machines holding the reboot lock and how many may.
+type LockStatus struct {
+	Max     int      `json:"max"`
+	Holders []string `json:"holders"`
+}
+
+// RebootLock is a semaphore shared by the machines that must not reboot at
+// the same time. Acquiring a lock already held by id succeeds, and so does
+// releasing one it doesn't hold.
+type RebootLock interface {
+	Acquire(id string) error
+	Release(id string) error
+	Status() (*LockStatus, error)
+}
+
+// fileLock keeps the holders in a JSON file, for machines sharing a file
+// system or for a single machine.
+type fileLock struct {
+	path string
+	max  int
+}
+
+func newFileLock(p string, max int) *fileLock {
+	return &fileLock{path: p, max: max}
+}
+
+// update runs fn on the holders with the file locked, and saves them if fn
+// changed them.
+func (l *fileLock) update(fn func(*LockStatus) (bool, error)) (*LockStatus, error) {
+	if err := os.MkdirAll(path.Dir(l.path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+
+	status := &LockStatus{Max: l.max, Holders: []string{}}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &status.Holders); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", l.path, err)
+		}
+	}
+
+	changed, err := fn(status)
+	if err != nil || !changed {
+		return status, err
+	}
+
+	data, _ = json.Marshal(status.Holders)
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return nil, err
+	}
+	return status, f.Sync()
+}
+
+func (l *fileLock) Acquire(id string) error {
+	_, err := l.update(func(status *LockStatus) (bool, error) {
+		if contains(status.Holders, id) {
+			return false, nil
+		}
+		if len(status.Holders) >= status.Max {
+			return false, ErrLockHeld
+		}
+		status.Holders = append(status.Holders, id)
+		return true, nil
+	})
+	return err
+}
+
+func (l *fileLock) Release(id string) error {
+	_, err := l.update(func(status *LockStatus) (bool, error) {
+		holders := []string{}
+		for _, h := range status.Holders {
+			if h != id {
+				holders = append(holders, h)
+			}
+		}
+		changed := len(holders) != len(status.Holders)
+		status.Holders = holders
+		return changed, nil
+	})
+	return err
+}
+
+func (l *fileLock) Status() (*LockStatus, error) {
+	return l.update(func(*LockStatus) (bool, error) {
+		return false, nil
+	})
+}
+
+// httpLock uses a lock server shared by a cluster. GET on its URL answers
+// with the LockStatus, POST on URL/id acquires a slot for id or answers 409
+// when they are all taken, and DELETE on URL/id releases it.
+type httpLock struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPLock(u string) *httpLock {
+	return &httpLock{
+		url:    strings.TrimSuffix(u, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (l *httpLock) do(method, u string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return l.client.Do(req)
+}
+
+func (l *httpLock) Acquire(id string) error {
+	res, err := l.do("POST", l.url+"/"+url.PathEscape(id))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200, 201, 204:
+		return nil
+	case 409:
+		return ErrLockHeld
+	}
+	return fmt.Errorf("Lock server answered %d to acquire", res.StatusCode)
+}
+
+func (l *httpLock) Release(id string) error {
+	res, err := l.do("DELETE", l.url+"/"+url.PathEscape(id))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200, 204, 404:
+		return nil
+	}
+	return fmt.Errorf("Lock server answered %d to release", res.StatusCode)
+}
+
+func (l *httpLock) Status() (*LockStatus, error) {
+	res, err := l.do("GET", l.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Lock server answered %d to status", res.StatusCode)
+	}
+	status := &LockStatus{}
+	if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("Invalid lock status: %s", err)
+	}
+	if status.Holders == nil {
+		status.Holders = []string{}
+	}
+	return status, nil
+}
+
+// newRebootLock picks the backend of the -reboot-lock option: a lock
+// server for an http or https URL, a file under the directory prefix
+// otherwise.
+func newRebootLock(o Options) RebootLock {
+	if strings.HasPrefix(o.RebootLock, "http://") || strings.HasPrefix(o.RebootLock, "https://") {
+		return newHTTPLock(o.RebootLock)
+	}
+	p := o.RebootLock
+	if p == "" {
+		p = path.Join(o.StateDir, "reboot-lock")
+	}
+	return newFileLock(path.Join(o.Dir, p), o.RebootLockMax)
+}
+
+// machineID names this machine in the reboot lock.
+func machineID(o Options) string {
+	if data, err := ioutil.ReadFile(path.Join(o.Dir, "/etc/machine-id")); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// rebootHost asks logind to reboot.
+func rebootHost() error {
+	conn, err := dbus.Connect(dbus.SystemBus)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Authenticate(); err != nil {
+		return err
+	}
+	_, err = callDbus(conn.Object(logindDest, logindPath), logindIface, "Reboot", false)
+	return err
+}
+
+// Rebooter reboots the host into an installed update once the update
+// policy allows it and the reboot lock is held, and releases the lock
+// after the reboot.
+type Rebooter struct {
+	ID   string
+	Lock RebootLock
+
+	// mightHold is set while the lock may be held by ID, which is also
+	// the case at start up when the host comes back from a reboot
+	mu        sync.Mutex
+	mightHold bool
+
+	// stop ends Run, which closes stopped once its D-Bus connection is
+	// closed
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newRebooter(o Options) *Rebooter {
+	return &Rebooter{
+		ID:        machineID(o),
+		Lock:      newRebootLock(o),
+		mightHold: true,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// Run follows update_engine until Stop is called.
+func (rb *Rebooter) Run() {
+	defer close(rb.stopped)
+	for {
+		if err := rb.watch(); err != nil {
+			log.Printf("Reboot coordinator: %s", err)
+		}
+		select {
+		case <-rb.stop:
+			return
+		case <-time.After(rebootRetryInterval):
+		}
+	}
+}
+
+// Stop ends Run and waits for it to let go of the bus.
+func (rb *Rebooter) Stop() {
+	close(rb.stop)
+	<-rb.stopped
+}
+
+func (rb *Rebooter) watch() error {
+	u, err := connectUpdateEngine()
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	events := make(chan *UpdateStatus, 1)
+	watch, err := u.WatchStatus(func(status *UpdateStatus) {
+		select {
+		case events <- status:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer watch.Cancel()
+
+	ticker := time.NewTicker(rebootCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := u.GetStatus()
+		if err != nil {
+			return err
+		}
+		if err := rb.check(status); err != nil {
+			log.Printf("Reboot coordinator: %s", err)
+		}
+
+		select {
+		case <-events:
+		case <-ticker.C:
+		case <-rb.stop:
+			return nil
+		}
+	}
+}
+
+// check reboots if an update waits for it and the policy and the lock
+// allow it, and releases the lock otherwise.
+func (rb *Rebooter) check(status *UpdateStatus) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if status.CurrentOperation != updateNeedReboot {
+		if !rb.mightHold {
+			return nil
+		}
+		if err := rb.Lock.Release(rb.ID); err != nil {
+			return err
+		}
+		rb.mightHold = false
+		return nil
+	}
+
+	policy, err := loadUpdatePolicy()
+	if err != nil {
+		return err
+	}
+	switch policy.RebootStrategy {
+	case RebootOff:
+		return nil
+	case RebootWindow:
+		if policy.Window == nil || !policy.Window.Contains(time.Now()) {
+			return nil
+		}
+	}
+
+	if err := rb.Lock.Acquire(rb.ID); err != nil {
+		if err == ErrLockHeld {
+			return nil
+		}
+		return err
+	}
+	rb.mightHold = true
+
+	log.Printf("Rebooting into %s", status.NewVersion)
+	return rebootHost()
+}
+
+// release gives up the slot of id, and stops this machine from rebooting
+// until the lock is acquired again if id is its own.
+func (rb *Rebooter) release(id string) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if err := rb.Lock.Release(id); err != nil {
+		return err
+	}
+	if id == rb.ID {
+		rb.mightHold = false
+	}
+	return nil
+}
+
+var rebooter *Rebooter
+
+type RebootLockInfo struct {
+	ID   string `json:"id"`
+	Held bool   `json:"held"`
+	*LockStatus
+}
+
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := rebooter.Lock.Status()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	info := &RebootLockInfo{
+		ID:         rebooter.ID,
+		Held:       contains(status.Holders, rebooter.ID),
+		LockStatus: status,
+	}
+	outJson, _ := json.Marshal(info)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+// releaseLockHandler releases the slot of this machine, or of the machine
+// given with ?id= when one can't release its own.
+func releaseLockHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if id == "" {
+		id = rebooter.ID
+	}
+	if err := rebooter.release(id); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	lockHandler(w, r)
+}
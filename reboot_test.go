@@ -0,0 +1,170 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockServer implements the lock server protocol httpLock expects.
+type lockServer struct {
+	sync.Mutex
+	status LockStatus
+	fail   bool
+}
+
+func (s *lockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if s.fail {
+		w.WriteHeader(500)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/lock/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/lock":
+		json.NewEncoder(w).Encode(s.status)
+	case r.Method == "POST" && id != r.URL.Path:
+		if contains(s.status.Holders, id) {
+			return
+		}
+		if len(s.status.Holders) >= s.status.Max {
+			w.WriteHeader(409)
+			return
+		}
+		s.status.Holders = append(s.status.Holders, id)
+		w.WriteHeader(201)
+	case r.Method == "DELETE" && id != r.URL.Path:
+		for i, h := range s.status.Holders {
+			if h == id {
+				s.status.Holders = append(s.status.Holders[:i], s.status.Holders[i+1:]...)
+				w.WriteHeader(204)
+				return
+			}
+		}
+		w.WriteHeader(404)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func checkHolders(t *testing.T, l RebootLock, want ...string) {
+	status, err := l.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Holders) != len(want) {
+		t.Fatalf("Holders are %v, want %v", status.Holders, want)
+	}
+	for i := range want {
+		if status.Holders[i] != want[i] {
+			t.Fatalf("Holders are %v, want %v", status.Holders, want)
+		}
+	}
+}
+
+func TestHTTPLock(t *testing.T) {
+	s := &lockServer{status: LockStatus{Max: 1, Holders: []string{}}}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	l := newRebootLock(Options{RebootLock: ts.URL + "/lock/"})
+	if _, ok := l.(*httpLock); !ok {
+		t.Fatalf("%s got a %T", ts.URL, l)
+	}
+
+	if err := l.Acquire("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("a"); err != nil {
+		t.Fatalf("Acquiring a held lock again: %s", err)
+	}
+	if err := l.Acquire("b"); err != ErrLockHeld {
+		t.Fatalf("Acquiring a full lock: %v", err)
+	}
+	checkHolders(t, l, "a")
+
+	if err := l.Release("b"); err != nil {
+		t.Fatalf("Releasing a lock that isn't held: %s", err)
+	}
+	if err := l.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("b"); err != nil {
+		t.Fatal(err)
+	}
+	checkHolders(t, l, "b")
+
+	s.Lock()
+	s.fail = true
+	s.Unlock()
+	if err := l.Acquire("a"); err == nil || err == ErrLockHeld {
+		t.Fatalf("Acquiring from a failing server: %v", err)
+	}
+	if err := l.Release("b"); err == nil {
+		t.Fatal("Releasing on a failing server succeeded")
+	}
+	if _, err := l.Status(); err == nil {
+		t.Fatal("Status of a failing server succeeded")
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd-rest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := newRebootLock(Options{Dir: dir, StateDir: "/state", RebootLockMax: 2})
+	for _, id := range []string{"a", "b", "a"} {
+		if err := l.Acquire(id); err != nil {
+			t.Fatalf("Acquiring for %s: %s", id, err)
+		}
+	}
+	if err := l.Acquire("c"); err != ErrLockHeld {
+		t.Fatalf("Acquiring past the max: %v", err)
+	}
+	checkHolders(t, l, "a", "b")
+
+	// The holders are kept in the file, not the lock
+	l = newFileLock(path.Join(dir, "state", "reboot-lock"), 2)
+	if err := l.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("c"); err != nil {
+		t.Fatal(err)
+	}
+	checkHolders(t, l, "b", "c")
+
+	status, err := l.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Max != 2 {
+		t.Fatalf("Max is %d, want 2", status.Max)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+)
+
+// RegistryConfig holds the settings of a self-hosted registry. They are
+// read from the registries setting, or else from registries.json in
+// StateDir, keyed by the registry host:
+//
+//	{"myreg.local:5000": {"insecure": true}, "reg.example.com": {"ca": "/etc/ssl/reg-ca.pem"}}
+type RegistryConfig struct {
+	// Insecure talks plain HTTP to the registry
+	Insecure bool `json:"insecure"`
+	// CA is a PEM file with the certificates that sign the registry's
+	CA string `json:"ca"`
+}
+
+func registryConfigPath(c *Context) string {
+	return path.Join(c.StatePath, "registries.json")
+}
+
+// loadRegistryConfig returns the settings of a registry host, or the
+// defaults if there are none.
+func loadRegistryConfig(c *Context, host string) (*RegistryConfig, error) {
+	if configs := settings().Registries; configs != nil {
+		if config, exists := configs[host]; exists {
+			return config, nil
+		}
+		return &RegistryConfig{}, nil
+	}
+
+	configs := make(map[string]*RegistryConfig)
+	data, err := ioutil.ReadFile(registryConfigPath(c))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", registryConfigPath(c), err)
+		}
+	}
+
+	if config, exists := configs[host]; exists {
+		return config, nil
+	}
+	return &RegistryConfig{}, nil
+}
+
+// registryTransport returns the index address and the transport used to
+// reach a registry host. The index is empty for the public index.
+func registryTransport(c *Context, host string) (string, *http.Transport, error) {
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		Proxy:             http.ProxyFromEnvironment,
+	}
+	if host == "" {
+		return "", transport, nil
+	}
+
+	config, err := loadRegistryConfig(c, host)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if config.CA != "" {
+		pem, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return "", nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", nil, fmt.Errorf("No certificates found in %s", config.CA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	scheme := "https"
+	if config.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v1", scheme, host), transport, nil
+}
+
+// registryFor returns a registry client for host, logged in with the
+// stored credentials of the host if there are any. The public index is
+// used when host is empty.
+func registryFor(c *Context, host string) (*registry.Registry, error) {
+	if host != "" && !validRegistryHost(host) {
+		return nil, fmt.Errorf("Invalid registry: %s", host)
+	}
+	authConfig, err := loadCredentials(c, host)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" && authConfig == nil {
+		return c.Registry, nil
+	}
+
+	index, transport, err := registryTransport(c, host)
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewRegistryIndex(authConfig, index, transport), nil
+}
@@ -0,0 +1,210 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testImageID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newTestContext returns a context with an empty graph under a temporary
+// directory, which the caller removes.
+func newTestContext(t *testing.T) (*Context, string) {
+	dir, err := ioutil.TempDir("", "systemd-rest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Context{
+		StatePath:     dir,
+		Path:          path.Join(dir, "docker"),
+		ContainerPath: path.Join(dir, "containers"),
+		StorageDriver: StorageCopy,
+		pinned:        make(map[string]int),
+	}
+	for _, p := range []string{path.Join(c.Path, "graph"), c.ContainerPath} {
+		if err := os.MkdirAll(p, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Graph, err = docker.NewGraph(path.Join(c.Path, "graph")); err != nil {
+		t.Fatal(err)
+	}
+	if c.Repositories, err = docker.NewTagStore(path.Join(c.Path, "repositories"), c.Graph); err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func testLayer(t *testing.T) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	body := []byte("hello\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(body)
+	tw.Close()
+	return b.Bytes()
+}
+
+// fakeRegistry serves the v1 registry API for the single layer image
+// testImageID, tagged latest in the repository app.
+func fakeRegistry(t *testing.T) http.Handler {
+	layer := testLayer(t)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/repositories/app/images":
+			w.Header().Set("X-Docker-Token", "token")
+			w.Header().Set("X-Docker-Endpoints", r.Host)
+			fmt.Fprintf(w, `[{"id": "%s"}]`, testImageID)
+		case "/v1/repositories/library/app/tags":
+			fmt.Fprintf(w, `{"latest": "%s"}`, testImageID)
+		case "/v1/images/" + testImageID + "/ancestry":
+			fmt.Fprintf(w, `["%s"]`, testImageID)
+		case "/v1/images/" + testImageID + "/json":
+			fmt.Fprintf(w, `{"id": "%s"}`, testImageID)
+		case "/v1/images/" + testImageID + "/layer":
+			w.Write(layer)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+}
+
+func pull(c *Context, name string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/registry/pull/{remote:.*}", func(w http.ResponseWriter, r *http.Request) {
+		pullHandler(w, r, c)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/registry/pull/"+name, nil))
+	return w
+}
+
+// testPull pulls host/app with the registry settings given and checks that
+// the image is stored and tagged.
+func testPull(t *testing.T, c *Context, host string, config *RegistryConfig) {
+	setLiveSettings(&liveSettings{Registries: map[string]*RegistryConfig{host: config}})
+	defer setLiveSettings(&liveSettings{})
+
+	w := pull(c, host+"/app")
+	if w.Code != 200 {
+		t.Fatalf("Pull answered %d: %s", w.Code, w.Body)
+	}
+
+	if !c.Graph.Exists(testImageID) {
+		t.Fatalf("%s was not stored", testImageID)
+	}
+	img, err := c.Repositories.GetImage(host+"/app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img == nil || img.ID != testImageID {
+		t.Fatalf("%s/app:latest is %v, want %s", host, img, testImageID)
+	}
+}
+
+func TestPullInsecureRegistry(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(fakeRegistry(t))
+	defer ts.Close()
+
+	testPull(t, c, strings.TrimPrefix(ts.URL, "http://"), &RegistryConfig{Insecure: true})
+}
+
+func TestPullRegistryWithCA(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewTLSServer(fakeRegistry(t))
+	defer ts.Close()
+
+	ca := path.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testPull(t, c, strings.TrimPrefix(ts.URL, "https://"), &RegistryConfig{CA: ca})
+}
+
+func TestPullRegistryUnknownCA(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewTLSServer(fakeRegistry(t))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	setLiveSettings(&liveSettings{Registries: map[string]*RegistryConfig{host: {}}})
+	defer setLiveSettings(&liveSettings{})
+
+	reg, err := registryFor(c, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.GetRepositoryData("app"); err == nil {
+		t.Fatal("A registry signed by an unknown CA was trusted")
+	}
+}
+
+func TestPullWithoutSpace(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	layers := 0
+	registry := fakeRegistry(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/layer") {
+			layers++
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	setLiveSettings(&liveSettings{
+		Registries: map[string]*RegistryConfig{host: {Insecure: true}},
+		MinFree:    1 << 62,
+	})
+	defer setLiveSettings(&liveSettings{})
+
+	if w := pull(c, host+"/app"); w.Code != 507 {
+		t.Fatalf("Pull answered %d: %s", w.Code, w.Body)
+	}
+	if layers != 0 {
+		t.Fatalf("%d layers were downloaded", layers)
+	}
+	if c.Graph.Exists(testImageID) {
+		t.Fatalf("%s was stored", testImageID)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Search results are cached for this long per registry and query
+const searchCacheTTL = time.Minute
+
+type searchCacheEntry struct {
+	results *registry.SearchResults
+	expires time.Time
+}
+
+var searchCache = struct {
+	sync.Mutex
+	entries map[string]*searchCacheEntry
+}{entries: make(map[string]*searchCacheEntry)}
+
+func searchRegistry(c *Context, host, term string) (*registry.SearchResults, error) {
+	key := host + "\x00" + term
+	now := time.Now()
+
+	searchCache.Lock()
+	if entry, exists := searchCache.entries[key]; exists && now.Before(entry.expires) {
+		searchCache.Unlock()
+		return entry.results, nil
+	}
+	searchCache.Unlock()
+
+	reg, err := registryFor(c, host)
+	if err != nil {
+		return nil, err
+	}
+	results, err := reg.SearchRepositories(term)
+	if err != nil {
+		return nil, err
+	}
+
+	searchCache.Lock()
+	defer searchCache.Unlock()
+	for k, entry := range searchCache.entries {
+		if now.After(entry.expires) {
+			delete(searchCache.entries, k)
+		}
+	}
+	searchCache.entries[key] = &searchCacheEntry{
+		results: results,
+		expires: now.Add(searchCacheTTL),
+	}
+	return results, nil
+}
+
+// searchHandler searches the public index, or the index of the registry
+// given with ?registry=host.
+func searchHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	term := r.FormValue("q")
+	if term == "" {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "Missing search term\n")
+		return
+	}
+
+	host := r.FormValue("registry")
+	if host == publicIndexName {
+		host = ""
+	}
+	if host != "" && !validRegistryHost(host) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid registry: %s\n", host)
+		return
+	}
+
+	results, err := searchRegistry(c, host, term)
+	if err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	outJson, _ := json.Marshal(results)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
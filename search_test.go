@@ -0,0 +1,87 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func search(c *Context, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/registry/search?"+query, nil), c)
+	return w
+}
+
+func TestSearchPrivateIndex(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	searches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/search") {
+			w.WriteHeader(404)
+			return
+		}
+		searches++
+		q := r.URL.Query().Get("q")
+		fmt.Fprintf(w, `{"query": "%s", "num_results": 1, "results": [{"name": "%s", "description": "Test", "star_count": 3}]}`, q, q)
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	setLiveSettings(&liveSettings{Registries: map[string]*RegistryConfig{host: {Insecure: true}}})
+	defer setLiveSettings(&liveSettings{})
+
+	for i := 0; i < 2; i++ {
+		w := search(c, "q=app&registry="+host)
+		if w.Code != 200 {
+			t.Fatalf("Search answered %d: %s", w.Code, w.Body)
+		}
+		var results registry.SearchResults
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results.Results) != 1 || results.Results[0].Name != "app" || results.Results[0].StarCount != 3 {
+			t.Fatalf("Search found %+v", results)
+		}
+	}
+	if searches != 1 {
+		t.Fatalf("The index was searched %d times, want once", searches)
+	}
+
+	if w := search(c, "q=web&registry="+host); w.Code != 200 || searches != 2 {
+		t.Fatalf("Another query answered %d after %d searches: %s", w.Code, searches, w.Body)
+	}
+}
+
+func TestSearchRefusals(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	for _, query := range []string{"", "registry=myreg.local", "q=app&registry=my%2Freg"} {
+		if w := search(c, query); w.Code != 400 {
+			t.Errorf("Search of %q answered %d: %s", query, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Stopped pulls and creates get this long to clean up after themselves
+const operationStopTimeout = 10 * time.Second
+
+var errShuttingDown = errors.New("Shutting down")
+
+// shutdown tracks the pulls and creates in progress. Once a shutdown starts
+// no new ones begin, and those running are stopped if they don't finish in
+// time.
+var shutdown = struct {
+	sync.Mutex
+	running  int
+	started  bool
+	draining chan struct{}
+	cancel   chan struct{}
+}{
+	draining: make(chan struct{}),
+	cancel:   make(chan struct{}),
+}
+
+// beginOperation registers a pull or create, unless a shutdown started.
+// Every successful call is paired with endOperation.
+func beginOperation() error {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+	if shutdown.started {
+		return errShuttingDown
+	}
+	shutdown.running++
+	return nil
+}
+
+func endOperation() {
+	shutdown.Lock()
+	shutdown.running--
+	shutdown.Unlock()
+}
+
+// draining is closed once a shutdown starts. Requests that would otherwise
+// run for as long as the client stays, such as event streams, end then.
+func draining() <-chan struct{} {
+	return shutdown.draining
+}
+
+// cancelled returns errShuttingDown once running operations must stop.
+func cancelled() error {
+	select {
+	case <-shutdown.cancel:
+		return errShuttingDown
+	default:
+		return nil
+	}
+}
+
+// cancelReader fails the reads of a layer once operations must stop, so that
+// the code extracting it gives up and removes what it wrote.
+type cancelReader struct {
+	io.Reader
+}
+
+func (r cancelReader) Read(p []byte) (int, error) {
+	if err := cancelled(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// closeOnCancel closes c once operations must stop, so that a read blocked
+// on it returns. The function returned stops watching.
+func closeOnCancel(c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-shutdown.cancel:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// drain stops accepting requests and lets those in progress finish for up
+// to timeout. Pulls and creates still running then are stopped, which
+// removes their partial layers and containers, and the connections left
+// after that are closed.
+func drain(server *http.Server, listeners *Listeners, timeout time.Duration) {
+	shutdown.Lock()
+	shutdown.started = true
+	close(shutdown.draining)
+	shutdown.Unlock()
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), timeout)
+	defer cancel()
+	if err := listeners.Shutdown(ctx); err == nil {
+		return
+	}
+
+	shutdown.Lock()
+	log.Printf("Stopping %d pulls and creates still running", shutdown.running)
+	close(shutdown.cancel)
+	shutdown.Unlock()
+	ctx, cancel = gocontext.WithTimeout(gocontext.Background(), operationStopTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Closing the connections left: %s", err)
+		server.Close()
+	}
+}
+
+// shutdownOnTerm drains the server and exits on SIGTERM or SIGINT. A
+// second signal exits at once.
+func shutdownOnTerm(server *http.Server, listeners *Listeners) {
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	<-term
+
+	sdNotify("STOPPING=1")
+	go func() {
+		<-term
+		log.Printf("Exiting without draining")
+		os.Exit(1)
+	}()
+
+	timeout := settings().ShutdownTimeout
+	log.Printf("Shutting down, giving requests %s to finish", timeout)
+	drain(server, listeners, timeout)
+	rebooter.Stop()
+	os.Exit(0)
+}
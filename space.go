@@ -0,0 +1,242 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/utils"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// SpaceError refuses a pull or create that would leave less than MinFree
+// bytes free.
+type SpaceError struct {
+	Path    string
+	Need    int64
+	Free    int64
+	MinFree int64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("Not enough space on %s: %d bytes needed, %d free, %d must stay free",
+		e.Path, e.Need, e.Free, e.MinFree)
+}
+
+// diskSpace returns the free and total bytes of the file system of p.
+func diskSpace(p string) (int64, int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// checkSpace makes sure need bytes can be written under p and still leave
+// MinFree bytes free.
+func checkSpace(c *Context, p string, need int64) error {
+	free, _, err := diskSpace(p)
+	if err != nil {
+		return err
+	}
+	minFree := settings().MinFree
+	if free-need < minFree {
+		return &SpaceError{Path: p, Need: need, Free: free, MinFree: minFree}
+	}
+	return nil
+}
+
+// writeOperationError answers the error of a pull, load or create: 507 for
+// a SpaceError, 503 for an operation stopped by a shutdown and 500
+// otherwise.
+func writeOperationError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*SpaceError); ok {
+		w.WriteHeader(507)
+	} else if err == errShuttingDown {
+		w.WriteHeader(503)
+	} else {
+		w.WriteHeader(500)
+	}
+	fmt.Fprintf(w, "%s\n", err)
+}
+
+// layerSizes caches the measured size of the layers stored before the size
+// was recorded, so that metrics scrapes and storage reports don't walk
+// them every time. Stored layers don't change.
+var layerSizes = struct {
+	sync.Mutex
+	sizes map[string]int64
+}{sizes: map[string]int64{}}
+
+// layerSize returns the size of the layer of an image. Images stored before
+// the size was recorded are measured once.
+func layerSize(c *Context, img *docker.Image) (int64, error) {
+	if img.Size > 0 {
+		return img.Size, nil
+	}
+
+	layerSizes.Lock()
+	size, exists := layerSizes.sizes[img.ID]
+	layerSizes.Unlock()
+	if exists {
+		return size, nil
+	}
+
+	size, err := utils.TreeSize(path.Join(c.Graph.Root, img.ID, "layer"))
+	if err != nil {
+		return 0, err
+	}
+	layerSizes.Lock()
+	layerSizes.sizes[img.ID] = size
+	layerSizes.Unlock()
+	return size, nil
+}
+
+// forgetLayerSize drops the cached size of a deleted image.
+func forgetLayerSize(id string) {
+	layerSizes.Lock()
+	delete(layerSizes.sizes, id)
+	layerSizes.Unlock()
+}
+
+// imageSize returns the size of all the layers of an image.
+func imageSize(c *Context, img *docker.Image) (int64, error) {
+	var size int64
+	err := img.WalkHistory(func(i *docker.Image) error {
+		s, err := layerSize(c, i)
+		size += s
+		return err
+	})
+	return size, err
+}
+
+// containerSize returns the space a container uses itself. Stacked
+// containers only own their rw layer.
+func containerSize(c *Context, container *Container) (int64, error) {
+	if container.Info != nil {
+		switch container.Info.Storage {
+		case StorageAUFS, StorageOverlay:
+			return utils.TreeSize(containerStoragePath(c, container.Name))
+		}
+	}
+	return utils.TreeSize(container.Path)
+}
+
+type ImageUsage struct {
+	ID          string   `json:"id"`
+	Tags        []string `json:"tags"`
+	Size        int64    `json:"size"`
+	VirtualSize int64    `json:"virtual_size"`
+}
+
+type ContainerUsage struct {
+	Name    string `json:"name"`
+	Storage string `json:"storage,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+type StorageUsage struct {
+	Path       string            `json:"path"`
+	Free       int64             `json:"free"`
+	Total      int64             `json:"total"`
+	MinFree    int64             `json:"min_free"`
+	Images     []*ImageUsage     `json:"images"`
+	Containers []*ContainerUsage `json:"containers"`
+}
+
+// storageHandler reports the free space under -D and the space used by
+// each image and container.
+func storageHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	free, total, err := diskSpace(c.Path)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	usage := &StorageUsage{
+		Path:       c.Path,
+		Free:       free,
+		Total:      total,
+		MinFree:    settings().MinFree,
+		Images:     []*ImageUsage{},
+		Containers: []*ContainerUsage{},
+	}
+
+	c.GraphLock.Lock()
+	images, err := c.Graph.All()
+	if err != nil {
+		c.GraphLock.Unlock()
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	byID := c.Repositories.ByID()
+	for _, img := range images {
+		size, err := layerSize(c, img)
+		if err != nil {
+			continue
+		}
+		virtualSize, err := imageSize(c, img)
+		if err != nil {
+			continue
+		}
+		tags := byID[img.ID]
+		if tags == nil {
+			tags = []string{}
+		}
+		usage.Images = append(usage.Images, &ImageUsage{
+			ID:          img.ID,
+			Tags:        tags,
+			Size:        size,
+			VirtualSize: virtualSize,
+		})
+	}
+	c.GraphLock.Unlock()
+	sort.Sort(imageUsageByID(usage.Images))
+
+	containers, err := listContainers(c)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	for _, container := range containers {
+		size, err := containerSize(c, container)
+		if err != nil {
+			continue
+		}
+		u := &ContainerUsage{Name: container.Name, Size: size}
+		if container.Info != nil {
+			u.Storage = container.Info.Storage
+		}
+		usage.Containers = append(usage.Containers, u)
+	}
+
+	outJson, _ := json.Marshal(usage)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+type imageUsageByID []*ImageUsage
+
+func (u imageUsageByID) Len() int           { return len(u) }
+func (u imageUsageByID) Less(i, j int) bool { return u[i].ID < u[j].ID }
+func (u imageUsageByID) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,63 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCreateWithoutSpace(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	loadTestImage(t, c)
+
+	setLiveSettings(&liveSettings{MinFree: 1 << 62})
+	defer setLiveSettings(&liveSettings{})
+
+	w := create(c, "web", url.Values{"image": {"app:v1"}})
+	if w.Code != 507 {
+		t.Fatalf("Create answered %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Lstat(path.Join(c.ContainerPath, "web")); !os.IsNotExist(err) {
+		t.Fatal("A container was created without the space for it")
+	}
+}
+
+func TestLoadWithoutSpace(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	setLiveSettings(&liveSettings{MinFree: 1 << 62})
+	defer setLiveSettings(&liveSettings{})
+
+	tarball := testTarball(t, map[string][]byte{
+		testImageID + "/json":      []byte(fmt.Sprintf(`{"id": "%s"}`, testImageID)),
+		testImageID + "/layer.tar": testLayer(t),
+	})
+	w := serveTransfer(c, "POST", "/images/load", bytes.NewReader(tarball))
+	if w.Code != 507 {
+		t.Fatalf("Load answered %d: %s", w.Code, w.Body)
+	}
+	if c.Graph.Exists(testImageID) {
+		t.Fatalf("%s was stored without the space for it", testImageID)
+	}
+}
@@ -1,12 +1,23 @@
 package docker
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Archive io.Reader
@@ -46,12 +57,174 @@ func (compression *Compression) Extension() string {
 	return ""
 }
 
+// WhiteoutPrefix marks a file of a layer that deletes the file of the
+// same name without the prefix from the layers below.
+const WhiteoutPrefix = ".wh."
+
+// Tar archives the directory at path. Uncompressed and gzip archives are
+// written natively, other compressions go through bsdtar.
 func Tar(path string, compression Compression) (io.Reader, error) {
+	switch compression {
+	case Uncompressed, Gzip:
+	default:
+		return TarBsdtar(path, compression)
+	}
+
+	pipeR, pipeW := io.Pipe()
+	go func() {
+		var w io.WriteCloser = pipeW
+		if compression == Gzip {
+			w = gzip.NewWriter(pipeW)
+		}
+		tw := tar.NewWriter(w)
+		err := tarDirectory(tw, path)
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil && compression == Gzip {
+			err = w.Close()
+		}
+		pipeW.CloseWithError(err)
+	}()
+	return pipeR, nil
+}
+
+// TarBsdtar archives the directory at path with bsdtar.
+func TarBsdtar(path string, compression Compression) (io.Reader, error) {
 	cmd := exec.Command("bsdtar", "-f", "-", "-C", path, "-c"+compression.Flag(), ".")
 	return CmdStream(cmd)
 }
 
+type inode struct {
+	dev, ino uint64
+}
+
+func tarDirectory(tw *tar.Writer, root string) error {
+	seen := make(map[inode]string)
+
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := "./" + filepath.ToSlash(rel)
+		if rel == "." {
+			name = "./"
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			// Sockets only make sense to the process that created them
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Name = name
+		if fi.IsDir() && name != "./" {
+			hdr.Name += "/"
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if first, exists := seen[key]; exists {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				seen[key] = name
+			}
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			xattrs, err := getXattrs(p)
+			if err != nil {
+				return err
+			}
+			for k, v := range xattrs {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords["SCHILY.xattr."+k] = v
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ExtractPolicy restricts what extracting an archive may create. Entries
+// outside of the destination are always rejected.
+type ExtractPolicy struct {
+	// NoSetuid rejects files with the setuid or setgid bit
+	NoSetuid bool `json:"nosetuid"`
+	// AllowDevices lets character and block devices be created
+	AllowDevices bool `json:"devices"`
+}
+
+// Rejected is an archive entry that wasn't extracted.
+type Rejected struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Bsdtar makes Untar and ApplyLayer extract with bsdtar instead of
+// natively, for archives with entries the native extraction can't create.
+// It is set once at startup.
+var Bsdtar bool
+
+// Untar extracts an archive into path as it is, whiteouts included, which
+// is what a layer stored for AUFS needs. The compression is detected;
+// archives Go can't decompress are converted by bsdtar first.
 func Untar(archive io.Reader, path string) error {
+	if Bsdtar {
+		return UntarBsdtar(archive, path)
+	}
+	rejected, err := extract(archive, path, &ExtractPolicy{AllowDevices: true}, false)
+	for _, r := range rejected {
+		utils.Debugf("Rejected %s: %s", r.Name, r.Reason)
+	}
+	return err
+}
+
+// ApplyLayer extracts a layer on top of the layers already extracted into
+// path. Whiteouts delete the files they mark instead of being extracted.
+// A nil policy allows devices and setuid files.
+func ApplyLayer(layer io.Reader, path string, policy *ExtractPolicy) ([]Rejected, error) {
+	if policy == nil {
+		policy = &ExtractPolicy{AllowDevices: true}
+	}
+	if Bsdtar {
+		return applyLayerBsdtar(layer, path, policy)
+	}
+	return extract(layer, path, policy, true)
+}
+
+// UntarBsdtar extracts an archive into path with bsdtar.
+func UntarBsdtar(archive io.Reader, path string) error {
 	cmd := exec.Command("bsdtar", "-f", "-", "-C", path, "-x")
 	cmd.Stdin = archive
 	// Hardcode locale environment for predictable outcome regardless of host configuration.
@@ -64,6 +237,440 @@ func Untar(archive io.Reader, path string) error {
 	return nil
 }
 
+// applyLayerBsdtar extracts a layer with bsdtar into a directory next to
+// dest, applies its whiteouts to dest and then moves in the files the
+// policy allows, like untarNative does for each entry.
+func applyLayerBsdtar(layer io.Reader, dest string, policy *ExtractPolicy) ([]Rejected, error) {
+	staging, err := ioutil.TempDir(filepath.Dir(dest), ".layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	if err := UntarBsdtar(layer, staging); err != nil {
+		return nil, err
+	}
+
+	var rejected []Rejected
+	walk := func(fn func(p, name string, fi os.FileInfo) error) error {
+		return filepath.Walk(staging, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || p == staging {
+				return err
+			}
+			name, err := filepath.Rel(staging, p)
+			if err != nil {
+				return err
+			}
+			return fn(p, name, fi)
+		})
+	}
+
+	// Whiteouts delete files of the layers below, not of this one
+	err = walk(func(p, name string, fi os.FileInfo) error {
+		base := filepath.Base(name)
+		if !strings.HasPrefix(base, WhiteoutPrefix) || strings.HasPrefix(base, WhiteoutPrefix+WhiteoutPrefix) {
+			return nil
+		}
+		target, err := whiteoutTarget(dest, name)
+		if err != nil {
+			rejected = append(rejected, Rejected{name, err.Error()})
+			return nil
+		}
+		return os.RemoveAll(target)
+	})
+	if err != nil {
+		return rejected, err
+	}
+
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	err = walk(func(p, name string, fi os.FileInfo) error {
+		if strings.HasPrefix(filepath.Base(name), WhiteoutPrefix) {
+			return nil
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		reason := rejectEntry(hdr, name, policy)
+		target, err := resolveInRoot(dest, name)
+		if reason == "" && err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			rejected = append(rejected, Rejected{name, reason})
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Replace whatever is in the way, unless both are directories
+		existing, err := os.Lstat(target)
+		if err == nil && !(existing.IsDir() && fi.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		if !fi.IsDir() {
+			// Renaming keeps the hard links within the layer
+			return os.Rename(p, target)
+		}
+
+		if err != nil {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+			if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+		xattrs, err := getXattrs(p)
+		if err != nil {
+			return err
+		}
+		for k, v := range xattrs {
+			if err := setXattr(target, k, v); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		dirs = append(dirs, dirTimes{target, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return rejected, err
+	}
+
+	// Moving the children in changed the times of the directories
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+			return rejected, err
+		}
+	}
+	return rejected, nil
+}
+
+func extract(archive io.Reader, dest string, policy *ExtractPolicy, applyWhiteouts bool) ([]Rejected, error) {
+	buf := bufio.NewReader(archive)
+	magic, _ := buf.Peek(6)
+
+	var r io.Reader = buf
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(buf)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		// Have bsdtar rewrite the archive uncompressed
+		cmd := exec.Command("bsdtar", "-c", "-f", "-", "@-")
+		cmd.Stdin = buf
+		plain, err := CmdStream(cmd)
+		if err != nil {
+			return nil, err
+		}
+		r = plain
+	}
+
+	return untarNative(r, dest, policy, applyWhiteouts)
+}
+
+// rejectEntry returns why the policy rejects an entry, or "" to extract
+// it. name is the cleaned name of the entry.
+func rejectEntry(hdr *tar.Header, name string, policy *ExtractPolicy) string {
+	outside := func(p string) bool {
+		return p == ".." || strings.HasPrefix(p, "../")
+	}
+
+	if path.IsAbs(hdr.Name) {
+		return "absolute path"
+	}
+	if outside(name) {
+		return "path outside of the root"
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		// Absolute targets resolve inside the container
+		if !path.IsAbs(hdr.Linkname) && outside(path.Join(path.Dir(name), hdr.Linkname)) {
+			return "symlink outside of the root"
+		}
+	case tar.TypeLink:
+		if path.IsAbs(hdr.Linkname) || outside(path.Clean(hdr.Linkname)) {
+			return "hard link outside of the root"
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if !policy.AllowDevices {
+			return "device node"
+		}
+	}
+	if policy.NoSetuid && hdr.Mode&06000 != 0 {
+		return "setuid or setgid file"
+	}
+	return ""
+}
+
+// resolveInRoot returns the host path of name as seen from inside root,
+// following symlinks in its directories as if root were /. The last
+// element of name is not followed.
+func resolveInRoot(root, name string) (string, error) {
+	dir, base := path.Split(path.Clean("/" + name))
+
+	resolved := "/"
+	todo := strings.Split(dir, "/")
+	for hops := 0; len(todo) > 0; {
+		elem := todo[0]
+		todo = todo[1:]
+		if elem == "" || elem == "." {
+			continue
+		}
+		if elem == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if hops++; hops > 255 {
+			return "", fmt.Errorf("Too many levels of symbolic links")
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return filepath.Join(root, resolved, base), nil
+}
+
+// whiteoutTarget returns the host path of the file the whiteout name
+// deletes, which must be strictly inside root.
+func whiteoutTarget(root, name string) (string, error) {
+	target := strings.TrimPrefix(path.Base(name), WhiteoutPrefix)
+	if target == "" || target == "." || target == ".." || strings.Contains(target, "/") {
+		return "", fmt.Errorf("invalid whiteout")
+	}
+	p, err := resolveInRoot(root, path.Join(path.Dir(name), target))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("whiteout outside of the root")
+	}
+	return p, nil
+}
+
+func untarNative(r io.Reader, dest string, policy *ExtractPolicy, applyWhiteouts bool) ([]Rejected, error) {
+	type dirTimes struct {
+		path  string
+		atime time.Time
+		mtime time.Time
+	}
+	var (
+		dirs     []dirTimes
+		rejected []Rejected
+	)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rejected, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if reason := rejectEntry(hdr, name, policy); reason != "" {
+			rejected = append(rejected, Rejected{hdr.Name, reason})
+			continue
+		}
+		if name == "." {
+			if hdr.Typeflag == tar.TypeDir {
+				dirs = append(dirs, dirTimes{dest, hdr.AccessTime, hdr.ModTime})
+			}
+			continue
+		}
+		p, err := resolveInRoot(dest, name)
+		if err != nil {
+			rejected = append(rejected, Rejected{hdr.Name, err.Error()})
+			continue
+		}
+
+		base := path.Base(name)
+		if applyWhiteouts && strings.HasPrefix(base, WhiteoutPrefix) {
+			// AUFS metadata such as .wh..wh.plnk has nothing to delete
+			if strings.HasPrefix(base, WhiteoutPrefix+WhiteoutPrefix) {
+				continue
+			}
+			target, err := whiteoutTarget(dest, name)
+			if err != nil {
+				rejected = append(rejected, Rejected{hdr.Name, err.Error()})
+				continue
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return rejected, err
+			}
+			continue
+		}
+
+		if err := extractEntry(tr, hdr, dest, p); err != nil {
+			return rejected, fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{p, hdr.AccessTime, hdr.ModTime})
+		}
+	}
+
+	// Extracting the children changed the times of the directories
+	for i := len(dirs) - 1; i >= 0; i-- {
+		atime := dirs[i].atime
+		if atime.IsZero() {
+			atime = dirs[i].mtime
+		}
+		if err := os.Chtimes(dirs[i].path, atime, dirs[i].mtime); err != nil {
+			return rejected, err
+		}
+	}
+	return rejected, nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest, p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// Replace whatever is in the way, unless both are directories
+	if fi, err := os.Lstat(p); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(p, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := resolveInRoot(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, p); err != nil {
+			return err
+		}
+		// A hard link shares the attributes of its target
+		return nil
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, p); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			mode |= syscall.S_IFBLK
+		case tar.TypeFifo:
+			mode |= syscall.S_IFIFO
+		}
+		if err := syscall.Mknod(p, mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			return err
+		}
+	default:
+		// Global headers and other metadata
+		return nil
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, "SCHILY.xattr.") {
+			continue
+		}
+		if err := setXattr(p, strings.TrimPrefix(k, "SCHILY.xattr."), v); err != nil {
+			return err
+		}
+	}
+	// Mkdir and OpenFile apply the umask, and chown clears setuid
+	if err := os.Chmod(p, tarFileMode(hdr.Mode)); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		atime := hdr.AccessTime
+		if atime.IsZero() {
+			atime = hdr.ModTime
+		}
+		if err := os.Chtimes(p, atime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarFileMode converts the permission bits of a tar header.
+func tarFileMode(mode int64) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
 // CmdStream executes a command, and returns its stdout as a stream.
 // If the command fails to run or doesn't complete successfully, an error
 // will be returned, including anything written on stderr.
@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// getXattrs returns the extended attributes of a file. File systems that
+// don't support them have none.
+func getXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		sz, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, sz)
+		if sz, err = syscall.Getxattr(path, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value[:sz])
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
+
+func mkdev(major, minor int64) int {
+	return int((major&0xfff)<<8 | minor&0xff | (minor&0xfff00)<<12)
+}
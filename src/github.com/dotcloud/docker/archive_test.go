@@ -1,10 +1,13 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"testing"
 	"time"
 )
@@ -75,3 +78,257 @@ func TestTarUntar(t *testing.T) {
 		t.Fatalf("Error stating %s: %s", tmp, err.Error())
 	}
 }
+
+func TestTarUntarHardlink(t *testing.T) {
+	src, err := ioutil.TempDir("", "docker-test-hardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := ioutil.WriteFile(path.Join(src, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path.Join(src, "a"), path.Join(src, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := Tar(src, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "docker-test-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := Untar(archive, tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := os.Stat(path.Join(tmp, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(path.Join(tmp, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatalf("%s and %s should be the same file", "a", "b")
+	}
+}
+
+func TestApplyLayerWhiteout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(path.Join(tmp, "etc", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"etc/.wh.old", "etc/new", ".wh..wh.plnk"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApplyLayer(buf, tmp, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/old", "etc/.wh.old", ".wh..wh.plnk"} {
+		if _, err := os.Lstat(path.Join(tmp, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been removed", name)
+		}
+	}
+	if _, err := os.Lstat(path.Join(tmp, "etc", "new")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyLayerPolicy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside, err := ioutil.TempDir("", "docker-test-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "/abs", Mode: 0600, Typeflag: tar.TypeReg},
+		{Name: "../up", Mode: 0600, Typeflag: tar.TypeReg},
+		{Name: "escape", Linkname: "../../..", Typeflag: tar.TypeSymlink},
+		{Name: "suid", Mode: 04755, Typeflag: tar.TypeReg},
+		{Name: "null", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+		{Name: "host", Linkname: outside, Typeflag: tar.TypeSymlink},
+		{Name: "host/file", Mode: 0600, Typeflag: tar.TypeReg},
+	}
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := ApplyLayer(buf, tmp, &ExtractPolicy{NoSetuid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 5 {
+		t.Fatalf("Expected 5 rejected entries, got %v", rejected)
+	}
+	if _, err := os.Lstat(path.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Fatalf("Extracting through an absolute symlink should stay inside the root")
+	}
+	if _, err := os.Lstat(path.Join(tmp, outside, "file")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyLayerBadWhiteout(t *testing.T) {
+	parent, err := ioutil.TempDir("", "docker-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	tmp := path.Join(parent, "root")
+	for _, dir := range []string{"dir/sub", "keep"} {
+		if err := os.MkdirAll(path.Join(tmp, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	names := []string{".wh..", "./.wh...", "dir/.wh...", "dir/sub/.wh..", "dir/.wh."}
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := ApplyLayer(buf, tmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != len(names) {
+		t.Fatalf("Expected %d rejected entries, got %v", len(names), rejected)
+	}
+	for _, dir := range []string{"dir/sub", "keep"} {
+		if _, err := os.Lstat(path.Join(tmp, dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestApplyLayerWhiteoutThroughSymlink(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside, err := ioutil.TempDir("", "docker-test-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink("../../../../../../..", path.Join(tmp, "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	name := path.Join("up", outside, ".wh.keep")
+	if err := os.Mkdir(path.Join(outside, "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApplyLayer(buf, tmp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path.Join(outside, "keep")); err != nil {
+		t.Fatalf("A whiteout deleted a file outside of the root: %s", err)
+	}
+}
+
+func TestApplyLayerBsdtar(t *testing.T) {
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		t.Skip("bsdtar isn't installed")
+	}
+	Bsdtar = true
+	defer func() { Bsdtar = false }()
+
+	tmp, err := ioutil.TempDir("", "docker-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(path.Join(tmp, "etc", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "etc/.wh.old", Mode: 0600, Typeflag: tar.TypeReg},
+		{Name: "etc/new", Mode: 0600, Typeflag: tar.TypeReg},
+		{Name: "etc/link", Linkname: "etc/new", Typeflag: tar.TypeLink},
+		{Name: "escape", Linkname: "../../..", Typeflag: tar.TypeSymlink},
+		{Name: "suid", Mode: 04755, Typeflag: tar.TypeReg},
+	}
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := ApplyLayer(buf, tmp, &ExtractPolicy{NoSetuid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 {
+		t.Fatalf("Expected 2 rejected entries, got %v", rejected)
+	}
+	for _, name := range []string{"etc/old", "etc/.wh.old", "escape", "suid"} {
+		if _, err := os.Lstat(path.Join(tmp, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not be in the root", name)
+		}
+	}
+	fi, err := os.Stat(path.Join(tmp, "etc", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(path.Join(tmp, "etc", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi, link) {
+		t.Fatal("etc/link should be a hard link to etc/new")
+	}
+}
@@ -68,7 +68,7 @@ func decodeAuth(authStr string) (*AuthConfig, error) {
 	if n > decLen {
 		return nil, fmt.Errorf("Something went wrong decoding auth config")
 	}
-	arr := strings.Split(string(decoded), ":")
+	arr := strings.SplitN(string(decoded), ":", 2)
 	if len(arr) != 2 {
 		return nil, fmt.Errorf("Invalid auth configuration file")
 	}
@@ -121,8 +121,12 @@ func SaveConfig(authConfig *AuthConfig) error {
 
 // try to register/login to the registry server
 func Login(authConfig *AuthConfig, store bool) (string, error) {
+	return LoginIndex(authConfig, IndexServerAddress(), &http.Client{}, store)
+}
+
+// try to register/login to the given index server, eg. a private registry
+func LoginIndex(authConfig *AuthConfig, indexServer string, client *http.Client, store bool) (string, error) {
 	storeConfig := false
-	client := &http.Client{}
 	reqStatusCode := 0
 	var status string
 	var reqBody []byte
@@ -133,7 +137,7 @@ func Login(authConfig *AuthConfig, store bool) (string, error) {
 
 	// using `bytes.NewReader(jsonBody)` here causes the server to respond with a 411 status.
 	b := strings.NewReader(string(jsonBody))
-	req1, err := http.Post(IndexServerAddress()+"/users/", "application/json; charset=utf-8", b)
+	req1, err := client.Post(indexServer+"/users/", "application/json; charset=utf-8", b)
 	if err != nil {
 		return "", fmt.Errorf("Server Error: %s", err)
 	}
@@ -153,7 +157,7 @@ func Login(authConfig *AuthConfig, store bool) (string, error) {
 			"Please check your e-mail for a confirmation link.")
 	} else if reqStatusCode == 400 {
 		if string(reqBody) == "\"Username or email already exists\"" {
-			req, err := http.NewRequest("GET", IndexServerAddress()+"/users/", nil)
+			req, err := http.NewRequest("GET", indexServer+"/users/", nil)
 			req.SetBasicAuth(authConfig.Username, authConfig.Password)
 			resp, err := client.Do(req)
 			if err != nil {
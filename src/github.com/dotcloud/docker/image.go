@@ -28,6 +28,7 @@ type Image struct {
 	Author          string    `json:"author,omitempty"`
 	Config          *Config   `json:"config,omitempty"`
 	Architecture    string    `json:"architecture,omitempty"`
+	Size            int64     `json:"Size,omitempty"`
 	graph           *Graph
 }
 
@@ -94,6 +95,12 @@ func StoreImage(img *Image, layerData Archive, root string, store bool) error {
 	if err := Untar(layerData, layer); err != nil {
 		return err
 	}
+	size, err := utils.TreeSize(layer)
+	if err != nil {
+		return err
+	}
+	img.Size = size
+
 	// Store the json ball
 	jsonData, err := json.Marshal(img)
 	if err != nil {
@@ -16,6 +16,17 @@ import (
 )
 
 var ErrAlreadyExists = errors.New("Image already exists")
+var ErrNoSignature = errors.New("Image is not signed")
+
+// Authenticate a request to a registry endpoint with the index tokens or,
+// for registries without an index, the credentials of the registry.
+func (r *Registry) setAuthorization(req *http.Request, token []string) {
+	if len(token) == 0 && r.authConfig != nil && len(r.authConfig.Username) > 0 {
+		req.SetBasicAuth(r.authConfig.Username, r.authConfig.Password)
+		return
+	}
+	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+}
 
 func doWithCookies(c *http.Client, req *http.Request) (*http.Response, error) {
 	for _, cookie := range c.Jar.Cookies(req.URL) {
@@ -31,7 +42,7 @@ func (r *Registry) GetRemoteHistory(imgId, registry string, token []string) ([]s
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	r.setAuthorization(req, token)
 	res, err := r.client.Do(req)
 	if err != nil || res.StatusCode != 200 {
 		if res != nil {
@@ -72,7 +83,7 @@ func (r *Registry) LookupRemoteImage(imgId, registry string, authConfig *auth.Au
 }
 
 func (r *Registry) getImagesInRepository(repository string, authConfig *auth.AuthConfig) ([]map[string]string, error) {
-	u := auth.IndexServerAddress() + "/repositories/" + repository + "/images"
+	u := r.IndexServerAddress() + "/repositories/" + repository + "/images"
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -113,7 +124,7 @@ func (r *Registry) GetRemoteImageJSON(imgId, registry string, token []string) ([
 	if err != nil {
 		return nil, fmt.Errorf("Failed to download json: %s", err)
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	r.setAuthorization(req, token)
 	res, err := r.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to download json: %s", err)
@@ -129,12 +140,34 @@ func (r *Registry) GetRemoteImageJSON(imgId, registry string, token []string) ([
 	return jsonString, nil
 }
 
+// Retrieve the detached signature of an image from the Registry.
+// Returns ErrNoSignature if the registry has none.
+func (r *Registry) GetRemoteImageSignature(imgId, registry string, token []string) ([]byte, error) {
+	req, err := http.NewRequest("GET", registry+"/images/"+imgId+"/signature", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download signature: %s", err)
+	}
+	r.setAuthorization(req, token)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download signature: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, ErrNoSignature
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP code %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
 func (r *Registry) GetRemoteImageLayer(imgId, registry string, token []string) (io.ReadCloser, int, error) {
 	req, err := http.NewRequest("GET", registry+"/images/"+imgId+"/layer", nil)
 	if err != nil {
 		return nil, -1, fmt.Errorf("Error while getting from the server: %s\n", err)
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	r.setAuthorization(req, token)
 	res, err := r.client.Do(req)
 	if err != nil {
 		return nil, -1, err
@@ -149,17 +182,17 @@ func (r *Registry) GetRemoteTags(registries []string, repository string, token [
 		repository = "library/" + repository
 	}
 	for _, host := range registries {
-		endpoint := fmt.Sprintf("https://%s/v1/repositories/%s/tags", host, repository)
+		endpoint := fmt.Sprintf("%s/repositories/%s/tags", r.EndpointURL(host), repository)
 		req, err := http.NewRequest("GET", endpoint, nil)
 		if err != nil {
 			return nil, err
 		}
-		req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+		r.setAuthorization(req, token)
 		res, err := r.client.Do(req)
-		utils.Debugf("Got status code %d from %s", res.StatusCode, endpoint)
 		if err != nil {
 			return nil, err
 		}
+		utils.Debugf("Got status code %d from %s", res.StatusCode, endpoint)
 		defer res.Body.Close()
 
 		if res.StatusCode != 200 && res.StatusCode != 404 {
@@ -182,7 +215,7 @@ func (r *Registry) GetRemoteTags(registries []string, repository string, token [
 }
 
 func (r *Registry) GetRepositoryData(remote string) (*RepositoryData, error) {
-	repositoryTarget := auth.IndexServerAddress() + "/repositories/" + remote + "/images"
+	repositoryTarget := r.IndexServerAddress() + "/repositories/" + remote + "/images"
 
 	req, err := http.NewRequest("GET", repositoryTarget, nil)
 	if err != nil {
@@ -243,14 +276,14 @@ func (r *Registry) GetRepositoryData(remote string) (*RepositoryData, error) {
 
 // Push a local image to the registry
 func (r *Registry) PushImageJSONRegistry(imgData *ImgData, jsonRaw []byte, registry string, token []string) error {
-	registry = "https://" + registry + "/v1"
+	registry = r.EndpointURL(registry)
 	// FIXME: try json with UTF8
 	req, err := http.NewRequest("PUT", registry+"/images/"+imgData.ID+"/json", strings.NewReader(string(jsonRaw)))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-type", "application/json")
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ","))
+	r.setAuthorization(req, token)
 	req.Header.Set("X-Docker-Checksum", imgData.Checksum)
 
 	utils.Debugf("Setting checksum for %s: %s", imgData.ID, imgData.Checksum)
@@ -279,14 +312,14 @@ func (r *Registry) PushImageJSONRegistry(imgData *ImgData, jsonRaw []byte, regis
 }
 
 func (r *Registry) PushImageLayerRegistry(imgId string, layer io.Reader, registry string, token []string) error {
-	registry = "https://" + registry + "/v1"
+	registry = r.EndpointURL(registry)
 	req, err := http.NewRequest("PUT", registry+"/images/"+imgId+"/layer", layer)
 	if err != nil {
 		return err
 	}
 	req.ContentLength = -1
 	req.TransferEncoding = []string{"chunked"}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ","))
+	r.setAuthorization(req, token)
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
 		return fmt.Errorf("Failed to upload layer: %s", err)
@@ -308,14 +341,14 @@ func (r *Registry) PushImageLayerRegistry(imgId string, layer io.Reader, registr
 func (r *Registry) PushRegistryTag(remote, revision, tag, registry string, token []string) error {
 	// "jsonify" the string
 	revision = "\"" + revision + "\""
-	registry = "https://" + registry + "/v1"
+	registry = r.EndpointURL(registry)
 
 	req, err := http.NewRequest("PUT", registry+"/repositories/"+remote+"/tags/"+tag, strings.NewReader(revision))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-type", "application/json")
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ","))
+	r.setAuthorization(req, token)
 	req.ContentLength = int64(len(revision))
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
@@ -340,7 +373,7 @@ func (r *Registry) PushImageJSONIndex(remote string, imgList []*ImgData, validat
 
 	utils.Debugf("Image list pushed to index:\n%s\n", imgListJSON)
 
-	req, err := http.NewRequest("PUT", auth.IndexServerAddress()+"/repositories/"+remote+"/"+suffix, bytes.NewReader(imgListJSON))
+	req, err := http.NewRequest("PUT", r.IndexServerAddress()+"/repositories/"+remote+"/"+suffix, bytes.NewReader(imgListJSON))
 	if err != nil {
 		return nil, err
 	}
@@ -411,7 +444,7 @@ func (r *Registry) PushImageJSONIndex(remote string, imgList []*ImgData, validat
 }
 
 func (r *Registry) SearchRepositories(term string) (*SearchResults, error) {
-	u := auth.IndexServerAddress() + "/search?q=" + url.QueryEscape(term)
+	u := r.IndexServerAddress() + "/search?q=" + url.QueryEscape(term)
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -451,9 +484,17 @@ func (r *Registry) GetAuthConfig(withPasswd bool) *auth.AuthConfig {
 }
 
 type SearchResults struct {
-	Query      string              `json:"query"`
-	NumResults int                 `json:"num_results"`
-	Results    []map[string]string `json:"results"`
+	Query      string         `json:"query"`
+	NumResults int            `json:"num_results"`
+	Results    []SearchResult `json:"results"`
+}
+
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StarCount   int    `json:"star_count"`
+	IsOfficial  bool   `json:"is_official"`
+	IsTrusted   bool   `json:"is_trusted"`
 }
 
 type RepositoryData struct {
@@ -471,6 +512,37 @@ type ImgData struct {
 type Registry struct {
 	client     *http.Client
 	authConfig *auth.AuthConfig
+	index      string
+}
+
+// Return the address of the index this registry talks to
+func (r *Registry) IndexServerAddress() string {
+	if r.index != "" {
+		return r.index
+	}
+	return auth.IndexServerAddress()
+}
+
+// Return the v1 API URL of a registry endpoint returned by the index.
+// Endpoints use the same scheme as the index.
+func (r *Registry) EndpointURL(host string) string {
+	if strings.HasPrefix(r.IndexServerAddress(), "http://") {
+		return "http://" + host + "/v1"
+	}
+	return "https://" + host + "/v1"
+}
+
+// Split a repository name into the registry host and the name on that
+// registry. The host is empty for the public index.
+// Eg. "myreg.local:5000/app" -> ("myreg.local:5000", "app")
+func ResolveRepositoryName(reposName string) (string, string) {
+	nameParts := strings.SplitN(reposName, "/", 2)
+	if len(nameParts) == 1 || (!strings.Contains(nameParts[0], ".") &&
+		!strings.Contains(nameParts[0], ":") && nameParts[0] != "localhost") {
+		// This is a Docker Index repos (ex: samalba/hipache or ubuntu)
+		return "", reposName
+	}
+	return nameParts[0], nameParts[1]
 }
 
 func NewRegistry(root string, authConfig *auth.AuthConfig) *Registry {
@@ -478,11 +550,17 @@ func NewRegistry(root string, authConfig *auth.AuthConfig) *Registry {
 		DisableKeepAlives: true,
 		Proxy: http.ProxyFromEnvironment,
 	}
+	return NewRegistryIndex(authConfig, "", httpTransport)
+}
 
+// Create a registry talking to the given index, eg. "http://myreg.local:5000/v1",
+// through a custom transport. An empty index uses the public one.
+func NewRegistryIndex(authConfig *auth.AuthConfig, index string, transport http.RoundTripper) *Registry {
 	r := &Registry{
 		authConfig: authConfig,
+		index:      index,
 		client: &http.Client{
-			Transport: httpTransport,
+			Transport: transport,
 		},
 	}
 	r.client.Jar = cookiejar.NewCookieJar()
@@ -63,8 +63,8 @@ func (srv *Server) ImagesSearch(term string) ([]APISearch, error) {
 	var outs []APISearch
 	for _, repo := range results.Results {
 		var out APISearch
-		out.Description = repo["description"]
-		out.Name = repo["name"]
+		out.Description = repo.Description
+		out.Name = repo.Name
 		outs = append(outs, out)
 	}
 	return outs, nil
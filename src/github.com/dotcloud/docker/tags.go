@@ -221,7 +221,8 @@ func validateRepoName(name string) error {
 	if name == "" {
 		return fmt.Errorf("Repository name can't be empty")
 	}
-	if strings.Contains(name, ":") {
+	// A ':' is only allowed in the port of a registry host
+	if strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
 		return fmt.Errorf("Illegal repository name: %s", name)
 	}
 	return nil
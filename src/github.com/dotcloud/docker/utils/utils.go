@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -135,6 +136,30 @@ func HumanDuration(d time.Duration) string {
 	return fmt.Sprintf("%d years", d.Hours()/24/365)
 }
 
+// TreeSize returns the disk space used by the files under dir, counting
+// hard linked files once.
+func TreeSize(dir string) (int64, error) {
+	var size int64
+	seen := make(map[uint64]bool)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && !fi.IsDir() {
+			ino := uint64(st.Ino)
+			if st.Nlink > 1 {
+				if seen[ino] {
+					return nil
+				}
+				seen[ino] = true
+			}
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
+
 func Trunc(s string, maxlen int) string {
 	if len(s) <= maxlen {
 		return s
@@ -1,6 +1,22 @@
 package systemd
 
-import "launchpad.net/go-dbus"
+import (
+	"launchpad.net/go-dbus"
+	"time"
+)
+
+const (
+	systemdDest = "org.freedesktop.systemd1"
+	systemdPath = "/org/freedesktop/systemd1"
+	managerIface = "org.freedesktop.systemd1.Manager"
+	unitIface = "org.freedesktop.systemd1.Unit"
+	propertiesIface = "org.freedesktop.DBus.Properties"
+)
+
+// Observe, when set, is called after every call to systemd with the
+// interface and method called, how long it took and its error.
+var Observe func(iface, method string, duration time.Duration, err error)
+
 type Systemd1 struct {
 	conn   *dbus.Connection
 }
@@ -10,6 +26,20 @@ type Job struct {
 	Error string `json:"error"`
 }
 
+// Unit is a unit as listed by ListUnits.
+type Unit struct {
+	Name string `json:"name"`
+	Description string `json:"description"`
+	LoadState string `json:"load_state"`
+	ActiveState string `json:"active_state"`
+	SubState string `json:"sub_state"`
+	Following string `json:"following"`
+	Path string `json:"path"`
+	JobId uint32 `json:"job_id"`
+	JobType string `json:"job_type"`
+	JobPath string `json:"job_path"`
+}
+
 func (s *Systemd1) Connect() (err error) {
 	conn, err := dbus.Connect(dbus.SystemBus)
 	if err != nil {
@@ -23,11 +53,27 @@ func (s *Systemd1) Connect() (err error) {
 	return err
 }
 
-func (s *Systemd1) StartUnit(name string, mode string) (job Job, err error) {
-	obj := s.conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+func (s *Systemd1) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Systemd1) call(method string, args ...interface{}) (*dbus.Message, error) {
+	obj := s.conn.Object(systemdDest, systemdPath)
+
+	start := time.Now()
+	reply, err := obj.Call(managerIface, method, args...)
+	if Observe != nil {
+		Observe(managerIface, method, time.Since(start), err)
+	}
+
+	return reply, err
+}
 
-	reply, err := obj.Call("org.freedesktop.systemd1.Manager", "StartUnit",
-		name, mode)
+func (s *Systemd1) StartUnit(name string, mode string) (job Job, err error) {
+	reply, err := s.call("StartUnit", name, mode)
 	if err != nil {
 		return Job{"", err.Error()}, err
 	}
@@ -38,10 +84,7 @@ func (s *Systemd1) StartUnit(name string, mode string) (job Job, err error) {
 }
 
 func (s *Systemd1) StopUnit(name string, mode string) (job Job, err error) {
-	obj := s.conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
-
-	reply, err := obj.Call("org.freedesktop.systemd1.Manager", "StopUnit",
-		name, mode)
+	reply, err := s.call("StopUnit", name, mode)
 	if err != nil {
 		return Job{"", err.Error()}, err
 	}
@@ -51,15 +94,51 @@ func (s *Systemd1) StopUnit(name string, mode string) (job Job, err error) {
 	return job, err
 }
 
-func (s *Systemd1) ListUnits() (message string, err error) {
-	obj := s.conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+func (s *Systemd1) Reload() (err error) {
+	_, err = s.call("Reload")
+
+	return err
+}
+
+func (s *Systemd1) ListUnits() (units []Unit, err error) {
+	reply, err := s.call("ListUnits")
+	if err != nil {
+		return nil, err
+	}
+
+	err = reply.GetArgs(&units)
+
+	return units, err
+}
+
+// ActiveState returns the active state of a loaded unit, such as "active",
+// "deactivating" or "inactive".
+func (s *Systemd1) ActiveState(name string) (state string, err error) {
+	reply, err := s.call("GetUnit", name)
+	if err != nil {
+		return "", err
+	}
+
+	var unitPath dbus.ObjectPath
+	if err = reply.GetArgs(&unitPath); err != nil {
+		return "", err
+	}
 
-	reply, err := obj.Call("org.freedesktop.systemd1.Manager", "ListUnits")
+	obj := s.conn.Object(systemdDest, unitPath)
+	start := time.Now()
+	reply, err = obj.Call(propertiesIface, "Get", unitIface, "ActiveState")
+	if Observe != nil {
+		Observe(propertiesIface, "Get", time.Since(start), err)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	err = reply.GetArgs(&message)
+	var value dbus.Variant
+	if err = reply.GetArgs(&value); err != nil {
+		return "", err
+	}
+	state, _ = value.Value.(string)
 
-	return message, err
+	return state, nil
 }
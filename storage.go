@@ -0,0 +1,421 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Storage drivers decide how the rootfs of a container is laid out. AUFS
+// and overlay stack a per-container rw layer on top of the image layers,
+// btrfs snapshots a flattened copy of the image and copy untars every
+// layer into the rootfs.
+const (
+	StorageAuto    = "auto"
+	StorageAUFS    = "aufs"
+	StorageOverlay = "overlay"
+	StorageBtrfs   = "btrfs"
+	StorageCopy    = "copy"
+)
+
+const btrfsSuperMagic = 0x9123683E
+
+// snapshotLock keeps two creates from building the same btrfs base at once.
+var snapshotLock sync.Mutex
+
+// storageDrivers returns the drivers to try, in order, for a configured
+// driver. Every driver falls back to a full copy. Overlay is only used when
+// asked for, as it can't stack layers that delete files.
+func storageDrivers(driver string) ([]string, error) {
+	switch driver {
+	case StorageAuto, "":
+		return []string{StorageAUFS, StorageBtrfs, StorageCopy}, nil
+	case StorageAUFS, StorageOverlay, StorageBtrfs:
+		return []string{driver, StorageCopy}, nil
+	case StorageCopy:
+		return []string{StorageCopy}, nil
+	}
+	return nil, fmt.Errorf("Unknown storage driver: %s", driver)
+}
+
+// containerStoragePath is where a container keeps its rw layer.
+func containerStoragePath(c *Context, name string) string {
+	return path.Join(c.Path, "containers", name)
+}
+
+// btrfsBasePath is the flattened subvolume containers of an image are
+// snapshotted from.
+func btrfsBasePath(c *Context, id string) string {
+	return path.Join(c.ContainerPath, ".btrfs", id)
+}
+
+// imageLayers returns the layer directories of an image, top most first.
+func imageLayers(c *Context, img *docker.Image) ([]string, error) {
+	history, err := img.History()
+	if err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, i := range history {
+		layers = append(layers, path.Join(c.Graph.Root, i.ID, "layer"))
+	}
+	return layers, nil
+}
+
+// parseExtractPolicy reads what the layers of a new container may create
+// from the setuid and devices form values. Setuid files are allowed and
+// devices rejected unless asked otherwise.
+func parseExtractPolicy(r *http.Request) (*docker.ExtractPolicy, error) {
+	policy := &docker.ExtractPolicy{}
+
+	if setuid := r.FormValue("setuid"); setuid != "" {
+		allow, err := strconv.ParseBool(setuid)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid setuid: %s", setuid)
+		}
+		policy.NoSetuid = !allow
+	}
+	if devices := r.FormValue("devices"); devices != "" {
+		allow, err := strconv.ParseBool(devices)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid devices: %s", devices)
+		}
+		policy.AllowDevices = allow
+	}
+	return policy, nil
+}
+
+// rejectReason tells why policy keeps a file of a layer out of a rootfs,
+// or returns "" if it doesn't.
+func rejectReason(policy *docker.ExtractPolicy, fi os.FileInfo) string {
+	if fi.Mode()&os.ModeDevice != 0 && !isWhiteout(fi) && !policy.AllowDevices {
+		return "device node"
+	}
+	if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && policy.NoSetuid {
+		return "setuid or setgid file"
+	}
+	return ""
+}
+
+// checkLayers makes sure the stored layers of an image have nothing the
+// policy rejects. Stacking drivers use the layers as they are, so only
+// copying can leave such files out.
+func checkLayers(c *Context, img *docker.Image, policy *docker.ExtractPolicy) error {
+	layers, err := imageLayers(c, img)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		err := filepath.Walk(layer, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if reason := rejectReason(policy, fi); reason != "" {
+				return fmt.Errorf("%s is a %s", p, reason)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createRootfs lays out the rootfs of a container at root, trying the
+// configured storage driver first. It returns the driver that was used and
+// the layer entries the policy kept out.
+func createRootfs(c *Context, name, root string, img *docker.Image, policy *docker.ExtractPolicy) (string, []docker.Rejected, error) {
+	drivers, err := storageDrivers(c.StorageDriver)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, driver := range drivers {
+		var rejected []docker.Rejected
+		if driver == StorageCopy {
+			if err = checkImageSpace(c, root, img); err == nil {
+				rejected, err = copyRootfs(root, img, policy)
+			}
+		} else if err = checkLayers(c, img, policy); err == nil {
+			_, err = createRootfsWith(c, driver, name, root, img)
+		}
+		if err == nil {
+			return driver, rejected, nil
+		}
+		log.Printf("Storage driver %s failed for %s: %s", driver, name, err)
+		if err := removeRootfs(c, driver, name, root); err != nil {
+			return "", nil, err
+		}
+		if cancelled() != nil {
+			return "", nil, errShuttingDown
+		}
+		if err := os.Mkdir(root, 0700); err != nil {
+			return "", nil, err
+		}
+	}
+	return "", nil, err
+}
+
+func createRootfsWith(c *Context, driver, name, root string, img *docker.Image) ([]docker.Rejected, error) {
+	switch driver {
+	case StorageAUFS:
+		rw := path.Join(containerStoragePath(c, name), "rw")
+		if err := os.MkdirAll(path.Dir(rw), 0700); err != nil {
+			return nil, err
+		}
+		return nil, img.Mount(root, rw)
+	case StorageOverlay:
+		return nil, mountOverlay(c, name, root, img)
+	case StorageBtrfs:
+		return nil, snapshotBtrfs(c, root, img)
+	case StorageCopy:
+		return copyRootfs(root, img, nil)
+	}
+	return nil, fmt.Errorf("Unknown storage driver: %s", driver)
+}
+
+// mountRootfs mounts the rootfs of a container again, e.g. after a reboot.
+// Only the stacking drivers need this.
+func mountRootfs(c *Context, name string, info *ContainerInfo) error {
+	if info.Storage != StorageAUFS && info.Storage != StorageOverlay {
+		return nil
+	}
+	root := path.Join(c.ContainerPath, name)
+	if mounted, err := docker.Mounted(root); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	img, err := c.Graph.Get(info.Image)
+	if err != nil {
+		return err
+	}
+	_, err = createRootfsWith(c, info.Storage, name, root, img)
+	return err
+}
+
+// removeRootfs unmounts and deletes the rootfs of a container and any
+// layers the storage driver kept for it.
+func removeRootfs(c *Context, driver, name, root string) error {
+	switch driver {
+	case StorageAUFS, StorageOverlay:
+		if mounted, err := docker.Mounted(root); err != nil {
+			return err
+		} else if mounted {
+			if err := docker.Unmount(root); err != nil {
+				return err
+			}
+		}
+	case StorageBtrfs:
+		if isBtrfsSubvolume(root) {
+			if err := btrfs("subvolume", "delete", root); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The rootfs goes last, the container is listed until it is gone
+	if err := os.RemoveAll(containerStoragePath(c, name)); err != nil {
+		return err
+	}
+	return os.RemoveAll(root)
+}
+
+// checkImageSpace makes sure all layers of an image can be copied to p.
+func checkImageSpace(c *Context, p string, img *docker.Image) error {
+	size, err := imageSize(c, img)
+	if err != nil {
+		return err
+	}
+	return checkSpace(c, p, size)
+}
+
+// copyRootfs extracts every layer of an image into root, leaving out what
+// the policy rejects.
+func copyRootfs(root string, img *docker.Image, policy *docker.ExtractPolicy) ([]docker.Rejected, error) {
+	images, err := img.History()
+	if err != nil {
+		return nil, err
+	}
+
+	var rejected []docker.Rejected
+	for i := len(images) - 1; i >= 0; i-- {
+		if err := cancelled(); err != nil {
+			return rejected, err
+		}
+		img := images[i]
+		log.Printf("Copying %s into %s", img.ID, root)
+		tarball, err := img.TarLayer(docker.Uncompressed)
+		if err != nil {
+			return rejected, err
+		}
+		r, err := docker.ApplyLayer(cancelReader{tarball}, root, policy)
+		rejected = append(rejected, r...)
+		if err != nil {
+			return rejected, err
+		}
+	}
+	return rejected, nil
+}
+
+var errWhiteoutFound = errors.New("Whiteout found")
+
+// findWhiteout returns the first AUFS whiteout in the layers, if any.
+func findWhiteout(layers []string) (string, error) {
+	found := ""
+	for _, layer := range layers {
+		err := filepath.Walk(layer, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(fi.Name(), docker.WhiteoutPrefix) {
+				found = p
+				return errWhiteoutFound
+			}
+			return nil
+		})
+		if err == errWhiteoutFound {
+			return found, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// mountOverlay mounts the image layers read-only with the rw layer of the
+// container on top. Overlay doesn't understand the AUFS whiteouts in the
+// layers, deleted files would show again, so images with whiteouts are
+// refused and left to the next driver.
+func mountOverlay(c *Context, name, root string, img *docker.Image) error {
+	layers, err := imageLayers(c, img)
+	if err != nil {
+		return err
+	}
+	if whiteout, err := findWhiteout(layers); err != nil {
+		return err
+	} else if whiteout != "" {
+		return fmt.Errorf("Overlay can't apply the AUFS whiteout %s", whiteout)
+	}
+
+	upper := path.Join(containerStoragePath(c, name), "rw")
+	work := path.Join(containerStoragePath(c, name), "work")
+	for _, p := range []string{upper, work} {
+		if err := os.MkdirAll(p, 0700); err != nil {
+			return err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(layers, ":"), upper, work)
+	if err := syscall.Mount("overlay", root, "overlay", 0, options); err != nil {
+		return fmt.Errorf("Unable to mount using overlay: %s", err)
+	}
+	return nil
+}
+
+// snapshotBtrfs snapshots a flattened subvolume of the image, building it
+// the first time a container is created from the image.
+func snapshotBtrfs(c *Context, root string, img *docker.Image) error {
+	if !isBtrfs(c.ContainerPath) {
+		return fmt.Errorf("%s is not on btrfs", c.ContainerPath)
+	}
+
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	base := btrfsBasePath(c, img.ID)
+	if !isBtrfsSubvolume(base) {
+		if err := os.MkdirAll(path.Dir(base), 0700); err != nil {
+			return err
+		}
+		if err := checkImageSpace(c, path.Dir(base), img); err != nil {
+			return err
+		}
+		if err := btrfs("subvolume", "create", base); err != nil {
+			return err
+		}
+		// Containers with a stricter policy don't use the base
+		if _, err := copyRootfs(base, img, nil); err != nil {
+			btrfs("subvolume", "delete", base)
+			return err
+		}
+	}
+
+	// The snapshot creates root itself
+	if err := os.Remove(root); err != nil {
+		return err
+	}
+	return btrfs("subvolume", "snapshot", base, root)
+}
+
+// removeBtrfsBase drops the flattened subvolume of a deleted image.
+func removeBtrfsBase(c *Context, id string) error {
+	base := btrfsBasePath(c, id)
+	if !isBtrfsSubvolume(base) {
+		return nil
+	}
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	return btrfs("subvolume", "delete", base)
+}
+
+func isBtrfs(p string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return false
+	}
+	return st.Type == btrfsSuperMagic
+}
+
+// isBtrfsSubvolume reports whether p is the root of a btrfs subvolume,
+// which always has inode number 256.
+func isBtrfsSubvolume(p string) bool {
+	if !isBtrfs(p) {
+		return false
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.IsDir() && st.Ino == 256
+}
+
+func btrfs(args ...string) error {
+	output, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs %s: %s: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
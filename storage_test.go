@@ -0,0 +1,110 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestStorageDrivers(t *testing.T) {
+	for _, test := range []struct {
+		driver  string
+		drivers string
+	}{
+		{"", "aufs btrfs copy"},
+		{StorageAuto, "aufs btrfs copy"},
+		{StorageOverlay, "overlay copy"},
+		{StorageBtrfs, "btrfs copy"},
+		{StorageCopy, "copy"},
+		{"zfs", ""},
+	} {
+		drivers, err := storageDrivers(test.driver)
+		if test.drivers == "" {
+			if err == nil {
+				t.Errorf("The driver %q was accepted", test.driver)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(drivers, " "); got != test.drivers {
+			t.Errorf("The driver %q tries %s, want %s", test.driver, got, test.drivers)
+		}
+	}
+}
+
+func TestCreateRootfsFallback(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	if isBtrfs(c.ContainerPath) {
+		t.Skip("The temporary directory is on btrfs")
+	}
+
+	// The layer has a setuid file the policy keeps out
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, hdr := range []*tar.Header{
+		{Name: "hello", Mode: 0644, Typeflag: tar.TypeReg},
+		{Name: "su", Mode: 04755, Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	tarball := testTarball(t, map[string][]byte{
+		testImageID + "/json":      []byte(fmt.Sprintf(`{"id": "%s"}`, testImageID)),
+		testImageID + "/layer.tar": layer.Bytes(),
+	})
+	if w := serveTransfer(c, "POST", "/images/load", bytes.NewReader(tarball)); w.Code != 200 {
+		t.Fatalf("Load answered %d: %s", w.Code, w.Body)
+	}
+	img, err := c.Graph.Get(testImageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.StorageDriver = StorageBtrfs
+	root := path.Join(c.ContainerPath, "web")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	driver, rejected, err := createRootfs(c, "web", root, img, &docker.ExtractPolicy{NoSetuid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver != StorageCopy {
+		t.Fatalf("Created the rootfs with %s, want a copy", driver)
+	}
+	if len(rejected) != 1 || path.Clean(rejected[0].Name) != "su" {
+		t.Fatalf("Rejected %v, want su", rejected)
+	}
+	if _, err := os.Lstat(path.Join(root, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path.Join(root, "su")); !os.IsNotExist(err) {
+		t.Fatal("The setuid file was copied")
+	}
+}
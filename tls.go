@@ -0,0 +1,140 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// newTLSConfig builds the server side TLS settings. With a client CA every
+// client must present a certificate it signed.
+func newTLSConfig(o Options) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if o.TLSClientCA == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(o.TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates in %s", o.TLSClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// serverTLS holds the TLS settings in force, which a reload replaces for
+// the connections that follow it.
+var serverTLS = struct {
+	sync.RWMutex
+	config *tls.Config
+}{}
+
+func setTLSConfig(config *tls.Config) {
+	serverTLS.Lock()
+	serverTLS.config = config
+	serverTLS.Unlock()
+}
+
+// liveTLSConfig hands every new connection the TLS settings in force.
+func liveTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			serverTLS.RLock()
+			defer serverTLS.RUnlock()
+			return serverTLS.config, nil
+		},
+	}
+}
+
+// clientRoles maps client certificate subjects to the roles they are
+// given. A subject is matched in full, as in "CN=ci,O=Example", then by its
+// common name, then by "*" for any verified client:
+//
+//	{"CN=ci,O=Example": ["ci"], "admin.example.com": ["admin"], "*": ["viewer"]}
+var clientRoles = struct {
+	sync.RWMutex
+	roles map[string][]string
+}{roles: map[string][]string{}}
+
+func setClientRoles(roles map[string][]string) {
+	clientRoles.Lock()
+	clientRoles.roles = roles
+	clientRoles.Unlock()
+}
+
+func loadClientRoles(p string) (map[string][]string, error) {
+	roles := map[string][]string{}
+	if p == "" {
+		return roles, nil
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", p, err)
+	}
+	return roles, nil
+}
+
+// Caller is who made a request, as told by its client certificate.
+type Caller struct {
+	Subject string   `json:"subject"`
+	Name    string   `json:"name"`
+	Roles   []string `json:"roles"`
+}
+
+// callerOf identifies the caller of a request. Requests without a verified
+// client certificate have an empty subject and no roles.
+func callerOf(r *http.Request) *Caller {
+	caller := &Caller{Roles: []string{}}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return caller
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	caller.Subject = cert.Subject.String()
+	caller.Name = cert.Subject.CommonName
+
+	clientRoles.RLock()
+	defer clientRoles.RUnlock()
+	for _, key := range []string{caller.Subject, cert.Subject.CommonName, "*"} {
+		if roles, exists := clientRoles.roles[key]; exists {
+			caller.Roles = roles
+			break
+		}
+	}
+	return caller
+}
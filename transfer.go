@@ -0,0 +1,339 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Image tarballs use the layout of docker save: a directory per layer
+// holding VERSION, json and layer.tar, and a repositories file mapping
+// repository and tag to image ids.
+const (
+	tarballVersion      = "1.0"
+	tarballRepositories = "repositories"
+)
+
+// saveImage writes the history of an image to tw, root first.
+func saveImage(c *Context, tw *tar.Writer, history []*docker.Image) error {
+	for i := len(history) - 1; i >= 0; i-- {
+		if err := saveLayer(c, tw, history[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveLayer(c *Context, tw *tar.Writer, id string) error {
+	now := time.Now()
+
+	jsonRaw, err := ioutil.ReadFile(path.Join(c.Graph.Root, id, "json"))
+	if err != nil {
+		return err
+	}
+
+	layerData, err := c.Graph.TempLayerArchive(id, docker.Uncompressed, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+	defer os.Remove(layerData.Name())
+	defer layerData.Close()
+
+	if err := tw.WriteHeader(&tar.Header{Name: id + "/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: now}); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, id+"/VERSION", []byte(tarballVersion), now); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, id+"/json", jsonRaw, now); err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     id + "/layer.tar",
+		Mode:     0644,
+		Size:     layerData.Size,
+		Typeflag: tar.TypeReg,
+		ModTime:  now,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, layerData.File)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+		ModTime:  modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// pinSaved looks up the image to save and pins its history. The
+// repositories file is returned when the image is named by its repository
+// and tag. GraphLock must be held.
+func pinSaved(c *Context, pins *imagePins, name string) (*docker.Image, []*docker.Image, map[string]map[string]string, error) {
+	image, err := lookupImage(c, name)
+	if err != nil || image == nil {
+		return nil, nil, nil, err
+	}
+	history, err := image.History()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, img := range history {
+		pins.add(img.ID)
+	}
+
+	var repositories map[string]map[string]string
+	repo, tag := parseRepositoryTag(name)
+	if tagged, err := c.Repositories.GetImage(repo, tag); err == nil && tagged != nil && tagged.ID == image.ID {
+		repositories = map[string]map[string]string{
+			repo: {tag: image.ID},
+		}
+	}
+	return image, history, repositories, nil
+}
+
+// saveHandler streams an image and its history as a tarball. The
+// repository and tag are included when the image is named by them.
+func saveHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// The history is pinned rather than locked while it is streamed, so
+	// that a slow client doesn't hold up everything else using the graph
+	pins := &imagePins{c: c}
+	defer pins.release()
+
+	c.GraphLock.Lock()
+	image, history, repositories, err := pinSaved(c, pins, name)
+	c.GraphLock.Unlock()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if image == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Cannot find image: %s\n", name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	if err := saveImage(c, tw, history); err != nil {
+		// The status is sent already, cut the stream short instead
+		log.Printf("Failed to save %s: %s", name, err)
+		return
+	}
+
+	if repositories != nil {
+		data, _ := json.Marshal(repositories)
+		if err := writeTarFile(tw, tarballRepositories, data, time.Now()); err != nil {
+			log.Printf("Failed to save %s: %s", name, err)
+			return
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		log.Printf("Failed to save %s: %s", name, err)
+	}
+}
+
+// unpackTarball stores the files of an image tarball in dir. Only the
+// layer files and the repositories file are kept.
+func unpackTarball(archive io.Reader, dir string) error {
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name != tarballRepositories {
+			id, file := path.Split(name)
+			id = strings.TrimSuffix(id, "/")
+			if docker.ValidateID(id) != nil || strings.Contains(id, "/") {
+				continue
+			}
+			if file != "json" && file != "layer.tar" {
+				continue
+			}
+			if err := os.MkdirAll(path.Join(dir, id), 0700); err != nil {
+				return err
+			}
+		}
+
+		f, err := os.OpenFile(path.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// loadLayer registers the layer id unpacked in dir, after its parents.
+// loading holds the children being loaded, to refuse parents that loop.
+func loadLayer(c *Context, dir, id string, loading map[string]bool, loaded *[]string) error {
+	if c.Graph.Exists(id) {
+		return nil
+	}
+	if loading[id] {
+		return fmt.Errorf("Image %s is its own ancestor", id)
+	}
+	loading[id] = true
+	defer delete(loading, id)
+
+	jsonRaw, err := ioutil.ReadFile(path.Join(dir, id, "json"))
+	if err != nil {
+		return fmt.Errorf("Missing json of image %s", id)
+	}
+	img, err := docker.NewImgJSON(jsonRaw)
+	if err != nil {
+		return fmt.Errorf("Invalid json of image %s: %s", id, err)
+	}
+	if img.ID != id {
+		return fmt.Errorf("Image %s is stored as %s", img.ID, id)
+	}
+	if img.Parent != "" {
+		if err := loadLayer(c, dir, img.Parent, loading, loaded); err != nil {
+			return err
+		}
+	}
+
+	layer, err := os.Open(path.Join(dir, id, "layer.tar"))
+	if err != nil {
+		return fmt.Errorf("Missing layer of image %s", id)
+	}
+	defer layer.Close()
+
+	if err := c.Graph.Register(layer, false, img); err != nil {
+		return err
+	}
+	*loaded = append(*loaded, id)
+	return nil
+}
+
+// loadHandler registers the images of a tarball sent as the request body
+// and tags them as listed in its repositories file.
+func loadHandler(w http.ResponseWriter, r *http.Request, c *Context) {
+	// The tarball is unpacked before the layers are extracted
+	var need int64
+	if r.ContentLength > 0 {
+		need = 2 * r.ContentLength
+	}
+	if err := checkSpace(c, c.Path, need); err != nil {
+		writeOperationError(w, err)
+		return
+	}
+
+	dir, err := ioutil.TempDir(c.Path, "load")
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unpackTarball(r.Body, dir); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid image tarball: %s\n", err)
+		return
+	}
+
+	repositories := make(map[string]map[string]string)
+	if data, err := ioutil.ReadFile(path.Join(dir, tarballRepositories)); err == nil {
+		if err := json.Unmarshal(data, &repositories); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid repositories file: %s\n", err)
+			return
+		}
+	}
+
+	layers, err := ioutil.ReadDir(dir)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	c.GraphLock.Lock()
+	defer c.GraphLock.Unlock()
+
+	loaded := []string{}
+	for _, fi := range layers {
+		if !fi.IsDir() {
+			continue
+		}
+		if err := loadLayer(c, dir, fi.Name(), map[string]bool{}, &loaded); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+	}
+
+	tagged := []string{}
+	for repo, tags := range repositories {
+		for tag, id := range tags {
+			if err := c.Repositories.Set(repo, tag, id, true); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "%s\n", err)
+				return
+			}
+			tagged = append(tagged, repo+":"+tag)
+		}
+	}
+
+	out := map[string]interface{}{
+		"loaded": loaded,
+		"tagged": tagged,
+	}
+	outJson, _ := json.Marshal(out)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
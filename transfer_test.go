@@ -0,0 +1,135 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testParentID = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+
+// testTarball builds an image tarball from file names and contents.
+func testTarball(t *testing.T, files map[string][]byte) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for name, data := range files {
+		if err := writeTarFile(tw, name, data, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func serveTransfer(c *Context, method, url string, body io.Reader) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/images/load", func(w http.ResponseWriter, r *http.Request) {
+		loadHandler(w, r, c)
+	}).Methods("POST")
+	r.HandleFunc("/images/{name:.*}/save", func(w http.ResponseWriter, r *http.Request) {
+		saveHandler(w, r, c)
+	}).Methods("GET")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, url, body))
+	return w
+}
+
+func TestLoadMalformedTarball(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	w := serveTransfer(c, "POST", "/images/load", strings.NewReader("not a tarball, but long enough to be read as one or more blocks"+strings.Repeat(".", 512)))
+	if w.Code != 400 {
+		t.Fatalf("Load answered %d: %s", w.Code, w.Body)
+	}
+
+	tarball := testTarball(t, map[string][]byte{"repositories": []byte("{")})
+	if w := serveTransfer(c, "POST", "/images/load", bytes.NewReader(tarball)); w.Code != 400 {
+		t.Fatalf("Load of invalid repositories answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoadParentLoop(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	layer := testLayer(t)
+	tarball := testTarball(t, map[string][]byte{
+		testImageID + "/json":       []byte(fmt.Sprintf(`{"id": "%s", "parent": "%s"}`, testImageID, testParentID)),
+		testImageID + "/layer.tar":  layer,
+		testParentID + "/json":      []byte(fmt.Sprintf(`{"id": "%s", "parent": "%s"}`, testParentID, testImageID)),
+		testParentID + "/layer.tar": layer,
+	})
+
+	w := serveTransfer(c, "POST", "/images/load", bytes.NewReader(tarball))
+	if w.Code != 400 {
+		t.Fatalf("Load answered %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "its own ancestor") {
+		t.Fatalf("Load answered %s", w.Body)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+
+	layer := testLayer(t)
+	tarball := testTarball(t, map[string][]byte{
+		testParentID + "/json":      []byte(fmt.Sprintf(`{"id": "%s"}`, testParentID)),
+		testParentID + "/layer.tar": layer,
+		testImageID + "/json":       []byte(fmt.Sprintf(`{"id": "%s", "parent": "%s"}`, testImageID, testParentID)),
+		testImageID + "/layer.tar":  layer,
+		"repositories":              []byte(fmt.Sprintf(`{"app": {"v1": "%s"}}`, testImageID)),
+	})
+	if w := serveTransfer(c, "POST", "/images/load", bytes.NewReader(tarball)); w.Code != 200 {
+		t.Fatalf("Load answered %d: %s", w.Code, w.Body)
+	}
+
+	w := serveTransfer(c, "GET", "/images/app:v1/save", nil)
+	if w.Code != 200 {
+		t.Fatalf("Save answered %d: %s", w.Code, w.Body)
+	}
+	if len(c.pinned) != 0 {
+		t.Fatalf("Images still pinned after the save: %v", c.pinned)
+	}
+
+	other, otherDir := newTestContext(t)
+	defer os.RemoveAll(otherDir)
+	if w := serveTransfer(other, "POST", "/images/load", w.Body); w.Code != 200 {
+		t.Fatalf("Loading the saved image answered %d: %s", w.Code, w.Body)
+	}
+	img, err := other.Repositories.GetImage("app", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img == nil || img.ID != testImageID || img.Parent != testParentID {
+		t.Fatalf("app:v1 is %v after loading it", img)
+	}
+}
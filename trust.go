@@ -0,0 +1,254 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Trust policies decide what happens to images that aren't signed by a
+// trusted key. They are set per repository in trust/policy.json in
+// StateDir, with "*" for every other repository:
+//
+//	{"busybox": "require-signed", "myreg.local:5000/app": "warn", "*": "off"}
+const (
+	TrustRequireSigned = "require-signed"
+	TrustWarn          = "warn"
+	TrustOff           = "off"
+)
+
+// ErrUntrusted means an image has no signature by a trusted key.
+var ErrUntrusted = errors.New("Image is not signed by a trusted key")
+
+// UntrustedError is an image refused by a require-signed policy.
+type UntrustedError struct {
+	ID  string
+	Err error
+}
+
+func (e *UntrustedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ID, e.Err)
+}
+
+func trustPath(c *Context) string {
+	return path.Join(c.StatePath, "trust")
+}
+
+// loadTrustPolicy returns the policy of a repository.
+func loadTrustPolicy(c *Context, repo string) (string, error) {
+	policies := make(map[string]string)
+
+	p := path.Join(trustPath(c), "policy.json")
+	data, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &policies); err != nil {
+			return "", fmt.Errorf("Invalid %s: %s", p, err)
+		}
+	}
+	for name, policy := range policies {
+		switch policy {
+		case TrustRequireSigned, TrustWarn, TrustOff:
+		default:
+			return "", fmt.Errorf("Invalid trust policy for %s: %s", name, policy)
+		}
+	}
+
+	if policy, exists := policies[repo]; exists {
+		return policy, nil
+	}
+	if policy, exists := policies["*"]; exists {
+		return policy, nil
+	}
+	return TrustOff, nil
+}
+
+// loadTrustedKeys reads the PEM encoded public keys in trust/keys.
+func loadTrustedKeys(c *Context) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	dir := path.Join(trustPath(c), "keys")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".pem") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key in %s: %s", fi.Name(), err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// imageManifest is what the signature of an image covers: its id and the
+// checksum of its json and layer as listed by the index.
+func imageManifest(id, checksum string) []byte {
+	return []byte(id + "\n" + checksum + "\n")
+}
+
+// verifySignature checks a detached signature of manifest against the
+// trusted keys. RSA keys sign with PKCS #1 v1.5 and ECDSA keys with ASN.1
+// signatures, both over the SHA-256 of the manifest.
+func verifySignature(keys []crypto.PublicKey, manifest, sig []byte) error {
+	digest := sha256.Sum256(manifest)
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, digest[:], sig) {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, manifest, sig) {
+				return nil
+			}
+		}
+	}
+	return ErrUntrusted
+}
+
+// imageTrust is the policy and the keys images are checked with.
+type imageTrust struct {
+	Policy string
+	Keys   []crypto.PublicKey
+}
+
+func loadImageTrust(c *Context, repo string) (*imageTrust, error) {
+	policy, err := loadTrustPolicy(c, repo)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadTrustedKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	return &imageTrust{Policy: policy, Keys: keys}, nil
+}
+
+// enforce turns a failed verification into an error if the policy
+// requires signatures, or a warning otherwise.
+func (t *imageTrust) enforce(id string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if t.Policy == TrustRequireSigned {
+		return &UntrustedError{id, err}
+	}
+	log.Printf("Warning: %s: %s", id, err)
+	return nil
+}
+
+// saveSignature keeps the verified manifest and signature of an image in
+// its graph directory so it can be checked again before use.
+func saveSignature(c *Context, id string, manifest, sig []byte) error {
+	root := path.Join(c.Graph.Root, id)
+	if err := ioutil.WriteFile(path.Join(root, "manifest"), manifest, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(root, "signature"), sig, 0600)
+}
+
+// verifyStoredSignature checks the signature kept for an image against
+// the keys trusted now.
+func verifyStoredSignature(c *Context, keys []crypto.PublicKey, id string) error {
+	root := path.Join(c.Graph.Root, id)
+	manifest, err := ioutil.ReadFile(path.Join(root, "manifest"))
+	if os.IsNotExist(err) {
+		return ErrUntrusted
+	}
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(path.Join(root, "signature"))
+	if os.IsNotExist(err) {
+		return ErrUntrusted
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(manifest), id+"\n") {
+		return fmt.Errorf("Signature manifest is for another image")
+	}
+	return verifySignature(keys, manifest, sig)
+}
+
+// verifyImage checks the stored signatures of an image and its history
+// against the policies of the repositories the image is tagged in.
+func verifyImage(c *Context, img *docker.Image, name string) error {
+	repos := make(map[string]bool)
+	if name != "" {
+		repo, _ := parseRepositoryTag(name)
+		repos[repo] = true
+	}
+	for _, tagged := range c.Repositories.ByID()[img.ID] {
+		repo, _ := parseRepositoryTag(tagged)
+		repos[repo] = true
+	}
+	if len(repos) == 0 {
+		repos["*"] = true
+	}
+
+	// The strictest policy of the repositories applies
+	var trust *imageTrust
+	for repo := range repos {
+		t, err := loadImageTrust(c, repo)
+		if err != nil {
+			return err
+		}
+		if trust == nil || t.Policy == TrustRequireSigned || (t.Policy == TrustWarn && trust.Policy == TrustOff) {
+			trust = t
+		}
+	}
+	if trust.Policy == TrustOff {
+		return nil
+	}
+
+	return img.WalkHistory(func(i *docker.Image) error {
+		return trust.enforce(i.ID, verifyStoredSignature(c, trust.Keys, i.ID))
+	})
+}
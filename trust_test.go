@@ -0,0 +1,90 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func setTrustPolicy(t *testing.T, c *Context, policy string) {
+	if err := os.MkdirAll(trustPath(c), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(trustPath(c), "policy.json"), []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func create(c *Context, name string, form url.Values) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/container/create/{container:.*}", func(w http.ResponseWriter, r *http.Request) {
+		createHandler(w, r, c)
+	})
+	req := httptest.NewRequest("POST", "/container/create/"+name, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPullUnsigned(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	setTrustPolicy(t, c, `{"*": "require-signed"}`)
+
+	ts := httptest.NewServer(fakeRegistry(t))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	setLiveSettings(&liveSettings{Registries: map[string]*RegistryConfig{host: {Insecure: true}}})
+	defer setLiveSettings(&liveSettings{})
+
+	if w := pull(c, host+"/app"); w.Code != 403 {
+		t.Fatalf("Pulling an unsigned image answered %d: %s", w.Code, w.Body)
+	}
+	if c.Graph.Exists(testImageID) {
+		t.Fatalf("The unsigned %s was stored", testImageID)
+	}
+}
+
+func TestCreateUnsigned(t *testing.T) {
+	c, dir := newTestContext(t)
+	defer os.RemoveAll(dir)
+	loadTestImage(t, c)
+	setTrustPolicy(t, c, `{"app": "require-signed", "*": "off"}`)
+
+	w := create(c, "web", url.Values{"image": {"app:v1"}})
+	if w.Code != 403 {
+		t.Fatalf("Creating from an unsigned image answered %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Lstat(path.Join(c.ContainerPath, "web")); !os.IsNotExist(err) {
+		t.Fatal("A container was created from the unsigned image")
+	}
+
+	// The id of an image is held to the policies of its tags
+	if w := create(c, "web", url.Values{"image": {testImageID}}); w.Code != 403 {
+		t.Fatalf("Creating from the id of an unsigned image answered %d: %s", w.Code, w.Body)
+	}
+}
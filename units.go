@@ -31,6 +31,7 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 	)
 
 	s := new(systemd.Systemd1)
+	defer s.Close()
 	err := s.Connect()
 	if err != nil {
 		// TODO: Return 40* code
@@ -45,8 +46,7 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	outJson, _ := json.Marshal(out)
-	fmt.Println("%s\n", outJson)
-	fmt.Fprint(w, "%s\n", outJson)
+	fmt.Fprintf(w, "%s\n", outJson)
 }
 
 func unitHandler(w http.ResponseWriter, r *http.Request) {
@@ -56,6 +56,7 @@ func unitHandler(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	s := new(systemd.Systemd1)
+	defer s.Close()
 	err := s.Connect()
 	if err != nil {
 		// TODO: Return 40* code
@@ -69,6 +70,9 @@ func unitHandler(w http.ResponseWriter, r *http.Request) {
 	case "stop":
 		out, err = s.StopUnit(vars["unit"], vars["mode"])
 	}
+	if job, ok := out.(systemd.Job); ok && job.Id != "" {
+		w.Header().Set(jobHeader, job.Id)
+	}
 
 	if err != nil {
 		w.WriteHeader(404)
@@ -79,9 +83,9 @@ func unitHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func setupUnits(r *mux.Router, o Options) {
-	r.HandleFunc("", listHandler)
-	r.HandleFunc("/", listHandler)
-	r.HandleFunc("/{unit}/{method}/{mode}", unitHandler)
+	r.HandleFunc("", listHandler).Name("units")
+	r.HandleFunc("/", listHandler).Name("units")
+	r.HandleFunc("/{unit}/{method}/{mode}", unitHandler).Name("unit")
 
 	return
 }
@@ -18,39 +18,242 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
+	"launchpad.net/go-dbus"
+	"log"
 	"net/http"
-	"os/exec"
-	"io"
-	"fmt"
+	"path"
+	"time"
 )
 
-// TODO(bp): Use DBUS endpoints and make this JSON!
+// update_engine is reached on the system bus. Point DBUS_SYSTEM_BUS_ADDRESS
+// at another bus to talk to a fake one.
+const (
+	updateDest  = "com.coreos.update1"
+	updatePath  = dbus.ObjectPath("/com/coreos/update1")
+	updateIface = "com.coreos.update1.Manager"
+)
+
+// UpdateStatus is what update_engine reports from GetStatus and with its
+// StatusUpdate signal.
+type UpdateStatus struct {
+	LastCheckedTime  time.Time `json:"last_checked_time"`
+	Progress         float64   `json:"progress"`
+	CurrentOperation string    `json:"current_operation"`
+	NewVersion       string    `json:"new_version"`
+	NewSize          int64     `json:"new_size"`
+}
+
+// newUpdateStatus decodes the arguments of a GetStatus reply or a
+// StatusUpdate signal.
+func newUpdateStatus(msg *dbus.Message) (*UpdateStatus, error) {
+	var lastChecked int64
+	status := &UpdateStatus{}
+	err := msg.GetArgs(&lastChecked, &status.Progress, &status.CurrentOperation, &status.NewVersion, &status.NewSize)
+	if err != nil {
+		return nil, err
+	}
+	status.LastCheckedTime = time.Unix(lastChecked, 0).UTC()
+	return status, nil
+}
+
+// UpdateEngine is what systemd-rest uses of update_engine. Update1 talks to
+// it over D-Bus.
+type UpdateEngine interface {
+	AttemptUpdate() error
+	ResetStatus() error
+	GetStatus() (*UpdateStatus, error)
+	WatchStatus(handler func(*UpdateStatus)) (StatusWatch, error)
+	Close() error
+}
+
+// StatusWatch is a WatchStatus in progress.
+type StatusWatch interface {
+	Cancel() error
+}
+
+// connectUpdateEngine connects to update_engine, or to a fake in tests.
+var connectUpdateEngine = func() (UpdateEngine, error) {
+	u := new(Update1)
+	if err := u.Connect(); err != nil {
+		if u.conn != nil {
+			u.conn.Close()
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+type Update1 struct {
+	conn *dbus.Connection
+}
+
+func (u *Update1) Connect() error {
+	conn, err := dbus.Connect(dbus.SystemBus)
+	if err != nil {
+		return err
+	}
+	u.conn = conn
+	return conn.Authenticate()
+}
+
+func (u *Update1) Close() error {
+	return u.conn.Close()
+}
+
+func (u *Update1) object() *dbus.ObjectProxy {
+	return u.conn.Object(updateDest, updatePath)
+}
+
+// AttemptUpdate asks update_engine to check for an update and apply it.
+func (u *Update1) AttemptUpdate() error {
+	_, err := callDbus(u.object(), updateIface, "AttemptUpdate")
+	return err
+}
+
+// ResetStatus clears a finished or failed update.
+func (u *Update1) ResetStatus() error {
+	_, err := callDbus(u.object(), updateIface, "ResetStatus")
+	return err
+}
+
+func (u *Update1) GetStatus() (*UpdateStatus, error) {
+	reply, err := callDbus(u.object(), updateIface, "GetStatus")
+	if err != nil {
+		return nil, err
+	}
+	return newUpdateStatus(reply)
+}
+
+// WatchStatus calls handler with every StatusUpdate signal until the watch
+// is cancelled.
+func (u *Update1) WatchStatus(handler func(*UpdateStatus)) (StatusWatch, error) {
+	watch, err := u.object().WatchSignal(updateIface, "StatusUpdate", func(msg *dbus.Message) {
+		status, err := newUpdateStatus(msg)
+		if err != nil {
+			log.Printf("Invalid StatusUpdate signal: %s", err)
+			return
+		}
+		handler(status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watch, nil
+}
+
+// updateHandler runs an update_engine method and answers with the status
+// that follows it.
 func updateHandler(w http.ResponseWriter, r *http.Request) {
-	cmd := exec.Command("update_engine_client", "-update", "-omaha_url=http://update.core-os.net")
-	stdout, err := cmd.StdoutPipe()
+	vars := mux.Vars(r)
+
+	u, err := connectUpdateEngine()
 	if err != nil {
-		w.WriteHeader(400)
-		fmt.Fprint(w, err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
-	if err := cmd.Start(); err != nil {
-		w.WriteHeader(400)
-		fmt.Fprint(w, err)
+	defer u.Close()
+
+	switch vars["method"] {
+	case "", "attempt":
+		err = u.AttemptUpdate()
+	case "reset":
+		err = u.ResetStatus()
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
-	io.Copy(w, stdout)
-	if err := cmd.Wait(); err != nil {
-		w.WriteHeader(400)
-		fmt.Fprint(w, err)
+
+	status, err := u.GetStatus()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
 		return
 	}
-	return
+
+	outJson, _ := json.Marshal(status)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+// eventsHandler streams the status of update_engine as JSON, one object
+// per line, starting with the current status.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		fmt.Fprint(w, "Streaming is not supported\n")
+		return
+	}
+
+	u, err := connectUpdateEngine()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	defer u.Close()
+
+	// Slow clients miss intermediate updates rather than block the bus
+	events := make(chan *UpdateStatus, 16)
+	watch, err := u.WatchStatus(func(status *UpdateStatus) {
+		select {
+		case events <- status:
+		default:
+		}
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	defer watch.Cancel()
+
+	status, err := u.GetStatus()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for {
+		if err := enc.Encode(status); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case status = <-events:
+		case <-r.Context().Done():
+			return
+		case <-draining():
+			return
+		}
+	}
 }
 
 func setupUpdate(r *mux.Router, o Options) {
-	r.HandleFunc("", updateHandler)
-	r.HandleFunc("/", updateHandler)
+	updateConfPath = path.Join(o.Dir, updateConf)
+
+	rebooter = newRebooter(o)
+	go rebooter.Run()
+
+	// Requesting /update on its own starts an update, as it always did
+	r.HandleFunc("", updateHandler).Name("update")
+	r.HandleFunc("/", updateHandler).Name("update")
+	r.HandleFunc("/{method:status}", updateHandler).Methods("GET").Name("update")
+	r.HandleFunc("/{method:attempt|reset}", updateHandler).Methods("POST").Name("update")
+	r.HandleFunc("/events", eventsHandler).Methods("GET").Name("update-events")
+	r.HandleFunc("/policy", policyHandler).Methods("GET").Name("update-policy")
+	r.HandleFunc("/policy", setPolicyHandler).Methods("POST").Name("set-update-policy")
+	r.HandleFunc("/lock", lockHandler).Methods("GET").Name("reboot-lock")
+	r.HandleFunc("/lock", releaseLockHandler).Methods("DELETE").Name("release-reboot-lock")
 
 	return
 }
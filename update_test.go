@@ -0,0 +1,389 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"launchpad.net/go-dbus"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpdateEngine records the calls it gets and answers with status, or
+// with the errors set.
+type fakeUpdateEngine struct {
+	status    *UpdateStatus
+	callErr   error
+	statusErr error
+	calls     []string
+	closed    bool
+}
+
+func (f *fakeUpdateEngine) AttemptUpdate() error {
+	f.calls = append(f.calls, "AttemptUpdate")
+	return f.callErr
+}
+
+func (f *fakeUpdateEngine) ResetStatus() error {
+	f.calls = append(f.calls, "ResetStatus")
+	return f.callErr
+}
+
+func (f *fakeUpdateEngine) GetStatus() (*UpdateStatus, error) {
+	f.calls = append(f.calls, "GetStatus")
+	return f.status, f.statusErr
+}
+
+func (f *fakeUpdateEngine) WatchStatus(handler func(*UpdateStatus)) (StatusWatch, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (f *fakeUpdateEngine) Close() error {
+	f.closed = true
+	return nil
+}
+
+// useUpdateEngine makes the handlers connect to u, or fail with err, until
+// the function returned is called.
+func useUpdateEngine(u UpdateEngine, err error) func() {
+	connect := connectUpdateEngine
+	connectUpdateEngine = func() (UpdateEngine, error) {
+		return u, err
+	}
+	return func() { connectUpdateEngine = connect }
+}
+
+func serveUpdate(method, url string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/update/{method:status}", updateHandler).Methods("GET")
+	r.HandleFunc("/update/{method:attempt|reset}", updateHandler).Methods("POST")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+func equalCalls(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNewUpdateStatus(t *testing.T) {
+	msg := dbus.NewSignalMessage(updatePath, updateIface, "StatusUpdate")
+	if err := msg.AppendArgs(int64(1384000000), 0.5, "UPDATE_STATUS_DOWNLOADING", "1.2.3", int64(4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := newUpdateStatus(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UpdateStatus{
+		LastCheckedTime:  time.Unix(1384000000, 0).UTC(),
+		Progress:         0.5,
+		CurrentOperation: "UPDATE_STATUS_DOWNLOADING",
+		NewVersion:       "1.2.3",
+		NewSize:          4096,
+	}
+	if *status != want {
+		t.Fatalf("Decoded %+v, want %+v", status, want)
+	}
+}
+
+func TestNewUpdateStatusInvalid(t *testing.T) {
+	msg := dbus.NewSignalMessage(updatePath, updateIface, "StatusUpdate")
+	if err := msg.AppendArgs("UPDATE_STATUS_IDLE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newUpdateStatus(msg); err == nil {
+		t.Fatal("A status of the wrong arguments was decoded")
+	}
+}
+
+func TestUpdateHandlerStatus(t *testing.T) {
+	u := &fakeUpdateEngine{status: &UpdateStatus{
+		LastCheckedTime:  time.Unix(1384000000, 0).UTC(),
+		CurrentOperation: "UPDATE_STATUS_IDLE",
+	}}
+	defer useUpdateEngine(u, nil)()
+
+	w := serveUpdate("GET", "/update/status")
+	if w.Code != 200 {
+		t.Fatalf("Status answered %d: %s", w.Code, w.Body)
+	}
+	var status UpdateStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status != *u.status {
+		t.Fatalf("Answered %+v, want %+v", status, u.status)
+	}
+	if !equalCalls(u.calls, []string{"GetStatus"}) {
+		t.Fatalf("Called %v", u.calls)
+	}
+	if !u.closed {
+		t.Fatal("The connection was left open")
+	}
+}
+
+func TestUpdateHandlerMethods(t *testing.T) {
+	for method, call := range map[string]string{"attempt": "AttemptUpdate", "reset": "ResetStatus"} {
+		u := &fakeUpdateEngine{status: &UpdateStatus{CurrentOperation: "UPDATE_STATUS_CHECKING_FOR_UPDATE"}}
+		restore := useUpdateEngine(u, nil)
+		w := serveUpdate("POST", "/update/"+method)
+		restore()
+
+		if w.Code != 200 {
+			t.Fatalf("%s answered %d: %s", method, w.Code, w.Body)
+		}
+		if !equalCalls(u.calls, []string{call, "GetStatus"}) {
+			t.Fatalf("%s called %v", method, u.calls)
+		}
+	}
+}
+
+func TestUpdateHandlerErrors(t *testing.T) {
+	failed := errors.New("org.freedesktop.DBus.Error.ServiceUnknown")
+
+	defer useUpdateEngine(nil, failed)()
+	if w := serveUpdate("GET", "/update/status"); w.Code != 500 {
+		t.Fatalf("Failed connection answered %d: %s", w.Code, w.Body)
+	}
+
+	u := &fakeUpdateEngine{callErr: failed}
+	useUpdateEngine(u, nil)
+	if w := serveUpdate("POST", "/update/attempt"); w.Code != 500 {
+		t.Fatalf("Failed attempt answered %d: %s", w.Code, w.Body)
+	}
+	if !equalCalls(u.calls, []string{"AttemptUpdate"}) {
+		t.Fatalf("Failed attempt called %v", u.calls)
+	}
+
+	u = &fakeUpdateEngine{statusErr: failed}
+	useUpdateEngine(u, nil)
+	if w := serveUpdate("GET", "/update/status"); w.Code != 500 {
+		t.Fatalf("Failed status answered %d: %s", w.Code, w.Body)
+	}
+	if !u.closed {
+		t.Fatal("The connection was left open")
+	}
+}
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// privateBus starts a dbus-daemon of its own and points the system bus at
+// it until the function returned is called.
+func privateBus(t *testing.T) func() {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "systemd-rest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := path.Join(dir, "bus.conf")
+	if err := ioutil.WriteFile(config, []byte(fmt.Sprintf(busConfig, path.Join(dir, "bus"))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("dbus-daemon", "--nofork", "--print-address", "--config-file="+config)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	address, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+
+	old, set := os.LookupEnv("DBUS_SYSTEM_BUS_ADDRESS")
+	os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", strings.TrimSpace(address))
+	return func() {
+		if set {
+			os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", old)
+		} else {
+			os.Unsetenv("DBUS_SYSTEM_BUS_ADDRESS")
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+// busUpdateEngine serves the update_engine methods on the system bus,
+// answering GetStatus with status, and records the calls it gets.
+type busUpdateEngine struct {
+	sync.Mutex
+	conn  *dbus.Connection
+	calls []string
+}
+
+func newBusUpdateEngine(t *testing.T, status []interface{}) *busUpdateEngine {
+	conn, err := dbus.Connect(dbus.SystemBus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	e := &busUpdateEngine{conn: conn}
+
+	acquired := make(chan bool, 1)
+	conn.RequestName(updateDest, dbus.NameFlagDoNotQueue, func(*dbus.BusName) {
+		acquired <- true
+	}, func(*dbus.BusName) {
+		acquired <- false
+	})
+	if !<-acquired {
+		t.Fatalf("Couldn't own %s", updateDest)
+	}
+
+	calls := make(chan *dbus.Message)
+	conn.RegisterObjectPath(updatePath, calls)
+	go func() {
+		for call := range calls {
+			e.Lock()
+			e.calls = append(e.calls, call.Iface+"."+call.Member)
+			e.Unlock()
+
+			reply := dbus.NewMethodReturnMessage(call)
+			if call.Iface != updateIface {
+				reply = dbus.NewErrorMessage(call, "org.freedesktop.DBus.Error.UnknownInterface", call.Iface)
+			}
+			switch call.Member {
+			case "AttemptUpdate", "ResetStatus":
+			case "GetStatus":
+				reply.AppendArgs(status...)
+			default:
+				reply = dbus.NewErrorMessage(call, "org.freedesktop.DBus.Error.UnknownMethod", call.Member)
+			}
+			conn.Send(reply)
+		}
+	}()
+	return e
+}
+
+func (e *busUpdateEngine) Calls() []string {
+	e.Lock()
+	defer e.Unlock()
+	return append([]string(nil), e.calls...)
+}
+
+func TestUpdate1(t *testing.T) {
+	defer privateBus(t)()
+	e := newBusUpdateEngine(t, []interface{}{int64(1384000000), 0.25, "UPDATE_STATUS_DOWNLOADING", "1.2.3", int64(4096)})
+	defer e.conn.Close()
+
+	w := serveUpdate("POST", "/update/attempt")
+	if w.Code != 200 {
+		t.Fatalf("Attempt answered %d: %s", w.Code, w.Body)
+	}
+	want := []string{updateIface + ".AttemptUpdate", updateIface + ".GetStatus"}
+	if calls := e.Calls(); !equalCalls(calls, want) {
+		t.Fatalf("Attempt called %v, want %v", calls, want)
+	}
+
+	var status UpdateStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.LastCheckedTime != time.Unix(1384000000, 0).UTC() || status.Progress != 0.25 ||
+		status.CurrentOperation != "UPDATE_STATUS_DOWNLOADING" || status.NewVersion != "1.2.3" || status.NewSize != 4096 {
+		t.Fatalf("Attempt answered %+v", status)
+	}
+
+	u, err := connectUpdateEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	updates := make(chan *UpdateStatus, 1)
+	watch, err := u.WatchStatus(func(status *UpdateStatus) {
+		select {
+		case updates <- status:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Cancel()
+
+	// The watch learns the owner of updateDest in the background, so the
+	// signal is sent until it matches
+	timeout := time.After(5 * time.Second)
+	for {
+		signal := dbus.NewSignalMessage(updatePath, updateIface, "StatusUpdate")
+		signal.AppendArgs(int64(1384000000), 1.0, "UPDATE_STATUS_UPDATED_NEED_REBOOT", "1.2.3", int64(4096))
+		if err := e.conn.Send(signal); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case status := <-updates:
+			if status.CurrentOperation != "UPDATE_STATUS_UPDATED_NEED_REBOOT" || status.Progress != 1.0 {
+				t.Fatalf("StatusUpdate decoded as %+v", status)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("The StatusUpdate signal didn't arrive")
+		}
+	}
+}
+
+func TestUpdate1BadReply(t *testing.T) {
+	defer privateBus(t)()
+	e := newBusUpdateEngine(t, []interface{}{"UPDATE_STATUS_IDLE"})
+	defer e.conn.Close()
+
+	if w := serveUpdate("GET", "/update/status"); w.Code != 500 {
+		t.Fatalf("Status of a bad reply answered %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The update policy is kept in update.conf next to the settings of
+// update_engine, which reads SERVER from it as well.
+const (
+	updateConf      = "/etc/coreos/update.conf"
+	defaultOmahaURL = "http://update.core-os.net"
+)
+
+// Reboot strategies decide when the host reboots into an update.
+const (
+	RebootImmediate = "immediate"
+	RebootWindow    = "window"
+	RebootOff       = "off"
+)
+
+// updateConfPath is update.conf under the directory prefix.
+var updateConfPath = updateConf
+
+// updateConfLock serializes rewrites of update.conf
+var updateConfLock sync.Mutex
+
+// MaintenanceWindow is a weekly or daily time span in local time. Start is
+// "Sun 04:00" for a weekly window or "04:00" for a daily one, and Length is
+// a duration such as "1h30m".
+type MaintenanceWindow struct {
+	Start  string `json:"start"`
+	Length string `json:"length"`
+
+	daily   bool
+	weekday time.Weekday
+	offset  time.Duration
+	length  time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseMaintenanceWindow(start, length string) (*MaintenanceWindow, error) {
+	m := &MaintenanceWindow{Start: start, Length: length, daily: true}
+
+	clock := start
+	if fields := strings.Fields(start); len(fields) == 2 {
+		day, exists := weekdays[strings.ToLower(fields[0])]
+		if !exists {
+			return nil, fmt.Errorf("Invalid window start: %s", start)
+		}
+		m.daily = false
+		m.weekday = day
+		clock = fields[1]
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid window start: %s", start)
+	}
+	m.offset = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	m.length, err = time.ParseDuration(length)
+	if err != nil || m.length <= 0 {
+		return nil, fmt.Errorf("Invalid window length: %s", length)
+	}
+	limit := 7 * 24 * time.Hour
+	if m.daily {
+		limit = 24 * time.Hour
+	}
+	if m.length > limit {
+		return nil, fmt.Errorf("Window length is longer than %s: %s", limit, length)
+	}
+	return m, nil
+}
+
+// Contains tells whether t falls in the window.
+func (m *MaintenanceWindow) Contains(t time.Time) bool {
+	// The window t falls in may have opened up to a week before
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 7; i++ {
+		start := day.AddDate(0, 0, -i).Add(m.offset)
+		if !m.daily && start.Weekday() != m.weekday {
+			continue
+		}
+		if !t.Before(start) && t.Before(start.Add(m.length)) {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdatePolicy struct {
+	RebootStrategy string             `json:"reboot_strategy"`
+	Window         *MaintenanceWindow `json:"window,omitempty"`
+	Server         string             `json:"server"`
+
+	// serverSet tells whether update.conf overrides the server of the OS
+	serverSet bool
+}
+
+// readUpdateConf returns the lines of update.conf, which has one KEY=value
+// setting per line.
+func readUpdateConf() ([]string, error) {
+	data, err := ioutil.ReadFile(updateConfPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n"), nil
+}
+
+func loadUpdatePolicy() (*UpdatePolicy, error) {
+	lines, err := readUpdateConf()
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	for _, line := range lines {
+		if kv := strings.SplitN(strings.TrimSpace(line), "=", 2); len(kv) == 2 {
+			settings[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	policy := &UpdatePolicy{
+		RebootStrategy: RebootImmediate,
+		Server:         defaultOmahaURL,
+	}
+	if s := settings["REBOOT_STRATEGY"]; s != "" {
+		policy.RebootStrategy = s
+	}
+	if s := settings["SERVER"]; s != "" {
+		policy.Server = s
+		policy.serverSet = true
+	}
+	if settings["REBOOT_WINDOW_START"] != "" {
+		policy.Window, err = parseMaintenanceWindow(settings["REBOOT_WINDOW_START"], settings["REBOOT_WINDOW_LENGTH"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", updateConfPath, err)
+		}
+	}
+	return policy, nil
+}
+
+// saveUpdatePolicy rewrites the policy settings of update.conf and keeps
+// its other lines. SERVER is only written when it overrides the default,
+// so that update_engine keeps following the server of the OS otherwise.
+func saveUpdatePolicy(policy *UpdatePolicy) error {
+	lines, err := readUpdateConf()
+	if err != nil {
+		return err
+	}
+
+	settings := map[string]string{
+		"REBOOT_STRATEGY": policy.RebootStrategy,
+	}
+	if policy.serverSet {
+		settings["SERVER"] = policy.Server
+	}
+	if policy.Window != nil {
+		settings["REBOOT_WINDOW_START"] = policy.Window.Start
+		settings["REBOOT_WINDOW_LENGTH"] = policy.Window.Length
+	}
+	keys := []string{"REBOOT_STRATEGY", "REBOOT_WINDOW_START", "REBOOT_WINDOW_LENGTH", "SERVER"}
+
+	var out []string
+	for _, line := range lines {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 && contains(keys, kv[0]) {
+			continue
+		}
+		out = append(out, line)
+	}
+	for _, key := range keys {
+		if value, exists := settings[key]; exists {
+			out = append(out, key+"="+value)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(updateConfPath), 0755); err != nil {
+		return err
+	}
+	tmp := updateConfPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(out, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, updateConfPath)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func policyHandler(w http.ResponseWriter, r *http.Request) {
+	policy, err := loadUpdatePolicy()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	outJson, _ := json.Marshal(policy)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
+
+// setPolicyHandler changes the fields of the policy given in the form
+// reboot_strategy, window_start, window_length and server. An empty
+// window_start removes the window.
+func setPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	updateConfLock.Lock()
+	defer updateConfLock.Unlock()
+
+	policy, err := loadUpdatePolicy()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	r.ParseForm()
+	if _, exists := r.Form["reboot_strategy"]; exists {
+		policy.RebootStrategy = r.FormValue("reboot_strategy")
+	}
+	switch policy.RebootStrategy {
+	case RebootImmediate, RebootWindow, RebootOff:
+	default:
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid reboot strategy: %s\n", policy.RebootStrategy)
+		return
+	}
+
+	if _, exists := r.Form["window_start"]; exists {
+		policy.Window = nil
+		if start := r.FormValue("window_start"); start != "" {
+			policy.Window, err = parseMaintenanceWindow(start, r.FormValue("window_length"))
+			if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "%s\n", err)
+				return
+			}
+		}
+	}
+	if policy.RebootStrategy == RebootWindow && policy.Window == nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "The window strategy needs window_start and window_length\n")
+		return
+	}
+
+	if _, exists := r.Form["server"]; exists {
+		// An empty server drops the override
+		policy.Server = r.FormValue("server")
+		policy.serverSet = policy.Server != ""
+		if !policy.serverSet {
+			policy.Server = defaultOmahaURL
+		}
+		u, err := url.Parse(policy.Server)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid update server: %s\n", policy.Server)
+			return
+		}
+	}
+
+	if err := saveUpdatePolicy(policy); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	outJson, _ := json.Marshal(policy)
+	fmt.Fprintf(w, "%s\n", outJson)
+}
@@ -0,0 +1,82 @@
+/*
+*  Copyright 2013 CoreOS, Inc
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// setPolicy posts form to setPolicyHandler with update.conf holding conf,
+// and returns the file afterwards.
+func setPolicy(t *testing.T, conf string, form url.Values) string {
+	dir, err := ioutil.TempDir("", "systemd-rest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	updateConfPath = path.Join(dir, "update.conf")
+	defer func() { updateConfPath = updateConf }()
+
+	if conf != "" {
+		if err := ioutil.WriteFile(updateConfPath, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/update/policy", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	setPolicyHandler(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Setting %v answered %d: %s", form, w.Code, w.Body)
+	}
+
+	data, err := ioutil.ReadFile(updateConfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSetPolicyKeepsServer(t *testing.T) {
+	for _, test := range []struct {
+		conf string
+		form url.Values
+		want string
+	}{
+		// Changing the strategy doesn't pin the default server
+		{"GROUP=alpha\n", url.Values{"reboot_strategy": {"off"}}, "GROUP=alpha\nREBOOT_STRATEGY=off\n"},
+		{"", url.Values{"reboot_strategy": {"off"}}, "REBOOT_STRATEGY=off\n"},
+		// A server in the file stays
+		{"SERVER=https://a.example.com\nGROUP=beta\n", url.Values{"reboot_strategy": {"off"}},
+			"GROUP=beta\nREBOOT_STRATEGY=off\nSERVER=https://a.example.com\n"},
+		// A server in the request is written, an empty one dropped
+		{"GROUP=alpha\n", url.Values{"server": {"https://b.example.com"}},
+			"GROUP=alpha\nREBOOT_STRATEGY=immediate\nSERVER=https://b.example.com\n"},
+		{"SERVER=https://a.example.com\n", url.Values{"server": {""}}, "REBOOT_STRATEGY=immediate\n"},
+	} {
+		if got := setPolicy(t, test.conf, test.form); got != test.want {
+			t.Errorf("Setting %v on %q wrote %q, want %q", test.form, test.conf, got, test.want)
+		}
+	}
+}